@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/zalgonoise/ipcam-stream/ipcam"
+)
+
+// Export writes the recordings covering a time range into a single clip
+func Export(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+
+	out := fs.String("out", "~/", "Output directory containing the recordings")
+	camera := fs.String("name", "", "Camera name to export (required)")
+	from := fs.String("from", "", "Start of the time range (e.g. 2006-01-02 15:04)")
+	to := fs.String("to", "", "End of the time range (e.g. 2006-01-02 15:04)")
+	ext := fs.String("ext", ".mp4", "Exported clip extension")
+	target := fs.String("o", "", "Exported clip path (defaults to the exports folder in the output directory)")
+
+	tz := fs.String("tz", "Local", "Time zone for the time range and legacy file names (e.g. UTC, Europe/Lisbon)")
+
+	layout := fs.String("layout", ipcam.DefaultLayout, "Output path template used by the recorder")
+
+	fs.Parse(args)
+
+	*out = ipcam.ExpandPath(*out)
+
+	loc, err := ipcam.LoadLocation(*tz)
+	if err != nil {
+		fatal(err)
+	}
+
+	l, err := ipcam.ParseLayout(*layout, loc)
+	if err != nil {
+		fatal(err)
+	}
+
+	ipcam.New(stderr)
+
+	if *camera == "" {
+		fatal(errors.New("export requires a camera name (-name)"))
+	}
+
+	if *from == "" || *to == "" {
+		fatal(errors.New("export requires a time range (-from and -to)"))
+	}
+
+	start, err := parseTime(*from, loc)
+	if err != nil {
+		fatal(err)
+	}
+
+	end, err := parseTime(*to, loc)
+	if err != nil {
+		fatal(err)
+	}
+
+	idx, err := ipcam.OpenIndex(*out, l)
+	if err != nil || len(idx.Entries) == 0 {
+		idx, err = ipcam.RebuildIndex(*out, l)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if *target == "" {
+		*target = ipcam.ExportPath(*out, *camera, start, end, *ext)
+	}
+
+	manifest, err := ipcam.Export(idx, *camera, start, end, *target)
+	if err != nil {
+		fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(manifest); err != nil {
+		fatal(err)
+	}
+}
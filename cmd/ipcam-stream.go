@@ -1,9 +1,31 @@
 package cmd
 
 import (
+	"os"
+
 	"github.com/zalgonoise/ipcam-stream/ipcam"
+	"github.com/zalgonoise/zlog/log"
 )
 
+// stderr is the logger used by the subcommands, keeping stdout for their output
+var stderr = log.New(log.WithPrefix("ipcam-stream"), log.WithOut(os.Stderr), log.FormatText)
+
+var commands = map[string]func(args []string){
+	"export":    Export,
+	"passwd":    Passwd,
+	"protect":   Protect,
+	"query":     Query,
+	"retention": Retention,
+	"unprotect": Unprotect,
+}
+
 func Run() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
 	ipcam.New().Capture()
 }
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zalgonoise/ipcam-stream/ipcam"
+)
+
+// Passwd reads a password from stdin and prints its bcrypt hash, for the HTTP API
+// users in the config file
+func Passwd(args []string) {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	fs.Parse(args)
+
+	fmt.Fprint(os.Stderr, "password: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fatal(err)
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fatal(errors.New("password is empty"))
+	}
+
+	hash, err := ipcam.HashPassword(password)
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Println(hash)
+}
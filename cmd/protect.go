@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/zalgonoise/ipcam-stream/ipcam"
+)
+
+// Protect marks a recording or a time range as protected from rotation, or lists
+// the existing protections
+func Protect(args []string) {
+	fs := flag.NewFlagSet("protect", flag.ExitOnError)
+
+	out := fs.String("out", "~/", "Output directory containing the recordings")
+	path := fs.String("path", "", "Recording file to protect")
+	camera := fs.String("name", "", "Camera name to protect (all cameras if empty)")
+	from := fs.String("from", "", "Start of the time range to protect (e.g. 2006-01-02 15:04)")
+	to := fs.String("to", "", "End of the time range to protect (e.g. 2006-01-02 15:04)")
+	note := fs.String("note", "", "Reason for the protection")
+	tz := fs.String("tz", "Local", "Time zone for the time range (e.g. UTC, Europe/Lisbon)")
+	list := fs.Bool("list", false, "List the protected recordings and time ranges")
+
+	fs.Parse(args)
+
+	p, err := ipcam.OpenProtections(ipcam.ExpandPath(*out))
+	if err != nil {
+		fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	if *list {
+		if err := enc.Encode(p.List()); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	loc, err := ipcam.LoadLocation(*tz)
+	if err != nil {
+		fatal(err)
+	}
+
+	start, err := parseTime(*from, loc)
+	if err != nil {
+		fatal(err)
+	}
+
+	end, err := parseTime(*to, loc)
+	if err != nil {
+		fatal(err)
+	}
+
+	e, err := p.Add(&ipcam.Protection{
+		Path:   *path,
+		Camera: *camera,
+		From:   start,
+		To:     end,
+		Note:   *note,
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	if err := enc.Encode(e); err != nil {
+		fatal(err)
+	}
+}
+
+// Unprotect removes a protection by its ID
+func Unprotect(args []string) {
+	fs := flag.NewFlagSet("unprotect", flag.ExitOnError)
+
+	out := fs.String("out", "~/", "Output directory containing the recordings")
+	id := fs.String("id", "", "ID of the protection to remove")
+
+	fs.Parse(args)
+
+	p, err := ipcam.OpenProtections(ipcam.ExpandPath(*out))
+	if err != nil {
+		fatal(err)
+	}
+
+	if err := p.Remove(*id); err != nil {
+		fatal(err)
+	}
+}
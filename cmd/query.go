@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zalgonoise/ipcam-stream/ipcam"
+)
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02-15-04-05Z0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02-15-04-05",
+	"2006-01-02",
+}
+
+func parseTime(value string, loc *time.Location) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unable to parse time %q", value)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// Query lists the recordings covering a time range, as found in the recording index
+func Query(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+
+	out := fs.String("out", "~/", "Output directory containing the recordings")
+	camera := fs.String("name", "", "Camera name to filter by (all cameras if empty)")
+	from := fs.String("from", "", "Start of the time range (e.g. 2006-01-02 15:04)")
+	to := fs.String("to", "", "End of the time range (e.g. 2006-01-02 15:04)")
+	rebuild := fs.Bool("rebuild", false, "Rebuild the index by scanning the output directory")
+
+	tz := fs.String("tz", "Local", "Time zone for the time range and legacy file names (e.g. UTC, Europe/Lisbon)")
+
+	layout := fs.String("layout", ipcam.DefaultLayout, "Output path template used by the recorder")
+
+	fs.Parse(args)
+
+	*out = ipcam.ExpandPath(*out)
+
+	loc, err := ipcam.LoadLocation(*tz)
+	if err != nil {
+		fatal(err)
+	}
+
+	l, err := ipcam.ParseLayout(*layout, loc)
+	if err != nil {
+		fatal(err)
+	}
+
+	ipcam.New(stderr)
+
+	start, err := parseTime(*from, loc)
+	if err != nil {
+		fatal(err)
+	}
+
+	end, err := parseTime(*to, loc)
+	if err != nil {
+		fatal(err)
+	}
+
+	idx, err := ipcam.OpenIndex(*out, l)
+	if err != nil || *rebuild || len(idx.Entries) == 0 {
+		idx, err = ipcam.RebuildIndex(*out, l)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	entries := idx.Query(*camera, start, end)
+	if entries == nil {
+		entries = []*ipcam.IndexEntry{}
+	}
+
+	if err := enc.Encode(entries); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/zalgonoise/ipcam-stream/ipcam"
+)
+
+// Retention runs the recorder's retention once, or with -dry-run (the default)
+// only reports which recordings it would remove, without changing anything in
+// the output directory. It reads the recorder's retention settings from the
+// same flags, and config file, as the recorder
+func Retention(args []string) {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+
+	req := &ipcam.StreamRequest{}
+
+	dryRun := fs.Bool("dry-run", true, "Only report what retention would remove")
+	cfgFile := fs.String("cfg", "", "Recorder configuration file (JSON); flags set on the command line override its settings")
+
+	fs.StringVar(&req.Camera, "name", "ipcam", "Camera name, for the camera storage quota")
+	ipcam.RetentionFlags(fs, req)
+
+	fs.Parse(args)
+
+	if *cfgFile != "" {
+		if err := ipcam.LoadConfig(fs, req, *cfgFile); err != nil {
+			fatal(err)
+		}
+	}
+
+	s := ipcam.New(stderr)
+
+	if err := s.ConfigureRetention(req, *dryRun); err != nil {
+		fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(s.Retention(*dryRun)); err != nil {
+		fatal(err)
+	}
+
+	if !*dryRun {
+		s.Downsample()
+	}
+}
@@ -0,0 +1,271 @@
+package ipcam
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zalgonoise/zlog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleRead  = "read"
+	RoleAdmin = "admin"
+)
+
+const authRealm = "ipcam-stream"
+
+// AuthConfig lists the credentials accepted by the HTTP API. Read-only clients
+// may only use GET (and HEAD) requests; admins may also control the recorder.
+// If no credentials are configured, the API is open, which is only allowed on a
+// loopback address unless explicitly requested
+type AuthConfig struct {
+	Tokens []*APIToken `json:"tokens,omitempty"`
+	Users  []*APIUser  `json:"users,omitempty"`
+}
+
+// APIToken is a bearer token, sent as "Authorization: Bearer <token>"
+type APIToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+// APIUser is a HTTP basic auth user, with a bcrypt-hashed password
+type APIUser struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+func (a *AuthConfig) Enabled() bool {
+	return a != nil && (len(a.Tokens) > 0 || len(a.Users) > 0)
+}
+
+func (a *AuthConfig) Validate() error {
+	if a == nil {
+		return nil
+	}
+
+	for _, t := range a.Tokens {
+		if t.Token == "" {
+			return fmt.Errorf("token %q is empty", t.Name)
+		}
+		if err := validateRole(t.Role); err != nil {
+			return fmt.Errorf("token %q: %w", t.Name, err)
+		}
+	}
+
+	for _, u := range a.Users {
+		if u.Name == "" {
+			return errors.New("user name is empty")
+		}
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			return fmt.Errorf("user %q: password must be a bcrypt hash: %w", u.Name, err)
+		}
+		if err := validateRole(u.Role); err != nil {
+			return fmt.Errorf("user %q: %w", u.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func validateRole(role string) error {
+	if role != RoleRead && role != RoleAdmin {
+		return fmt.Errorf("unknown role %q (expected %q or %q)", role, RoleRead, RoleAdmin)
+	}
+	return nil
+}
+
+// loopback reports whether the listen address addr only accepts local
+// connections; an empty host listens on all interfaces
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// HashPassword returns the bcrypt hash of password, to use in the config file
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+const (
+	sessionCookie = "ipcam_session"
+	sessionTTL    = 12 * time.Hour
+)
+
+// session is issued (as a cookie) after a successful basic auth login, so that
+// browsers and players issuing many range requests don't pay for bcrypt on
+// each one
+type session struct {
+	name    string
+	role    string
+	expires time.Time
+}
+
+// authenticator checks the credentials of HTTP requests
+type authenticator struct {
+	cfg      *AuthConfig
+	mu       sync.Mutex
+	sessions map[string]*session
+	// users holds each user's session ID, so that clients which never keep the
+	// cookie (e.g. scripts using basic auth) share one session
+	users map[string]string
+}
+
+func newAuthenticator(cfg *AuthConfig) *authenticator {
+	return &authenticator{
+		cfg:      cfg,
+		sessions: map[string]*session{},
+		users:    map[string]string{},
+	}
+}
+
+// role returns the role for the request's credentials, and their name, or an
+// empty role if they are missing or invalid. A successful basic auth login
+// starts a session, returned as its ID
+func (a *authenticator) role(r *http.Request) (role, name, id string) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if sess := a.session(c.Value); sess != nil {
+			return sess.role, sess.name, ""
+		}
+	}
+
+	header := r.Header.Get("Authorization")
+
+	if token := strings.TrimPrefix(header, "Bearer "); token != header {
+		for _, t := range a.cfg.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return t.Role, t.Name, ""
+			}
+		}
+		return "", "", ""
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", "", ""
+	}
+
+	for _, u := range a.cfg.Users {
+		if u.Name == user && bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil {
+			return u.Role, u.Name, a.login(u)
+		}
+	}
+
+	return "", user, ""
+}
+
+func (a *authenticator) session(id string) *session {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sess, ok := a.sessions[id]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(sess.expires) {
+		delete(a.sessions, id)
+		return nil
+	}
+
+	return sess
+}
+
+// login starts a session for u, or extends its current one, returning its ID (or
+// an empty string if no random ID could be generated)
+func (a *authenticator) login(u *APIUser) string {
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for k, sess := range a.sessions {
+		if now.After(sess.expires) {
+			delete(a.sessions, k)
+			delete(a.users, sess.name)
+		}
+	}
+
+	if id, ok := a.users[u.Name]; ok {
+		if sess := a.sessions[id]; sess != nil && sess.role == u.Role {
+			sess.expires = now.Add(sessionTTL)
+			return id
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+
+	id := hex.EncodeToString(buf)
+
+	a.sessions[id] = &session{
+		name:    u.Name,
+		role:    u.Role,
+		expires: now.Add(sessionTTL),
+	}
+	a.users[u.Name] = id
+
+	return id
+}
+
+// wrap rejects requests without valid credentials; requests which change the
+// recorder's state (anything but GET and HEAD) require the admin role
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, name, id := a.role(r)
+
+		if role == "" {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("authenticate()").Message("unauthorized HTTP request").Metadata(log.Field{"path": r.URL.Path, "remote": r.RemoteAddr, "user": name}).Build()
+
+			if len(a.cfg.Users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`", charset="UTF-8"`)
+			}
+			writeResponse(w, http.StatusUnauthorized, &apiError{Error: "unauthorized"})
+			return
+		}
+
+		if role != RoleAdmin && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("authenticate()").Message("forbidden HTTP request").Metadata(log.Field{"path": r.URL.Path, "remote": r.RemoteAddr, "user": name}).Build()
+
+			writeResponse(w, http.StatusForbidden, &apiError{Error: "forbidden"})
+			return
+		}
+
+		if id != "" {
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    id,
+				Path:     "/",
+				MaxAge:   int(sessionTTL.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,183 @@
+package ipcam
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testAuthenticator(t *testing.T) *authenticator {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newAuthenticator(&AuthConfig{
+		Tokens: []*APIToken{
+			{Name: "viewer", Token: "read-token", Role: RoleRead},
+			{Name: "ops", Token: "admin-token", Role: RoleAdmin},
+		},
+		Users: []*APIUser{
+			{Name: "alice", Password: string(hash), Role: RoleAdmin},
+		},
+	})
+}
+
+func TestAuthenticatorWrap(t *testing.T) {
+	a := testAuthenticator(t)
+
+	handler := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, test := range []struct {
+		name   string
+		method string
+		setup  func(r *http.Request)
+		want   int
+	}{
+		{"no credentials", http.MethodGet, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"read token GET", http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "Bearer read-token") }, http.StatusNoContent},
+		{"read token HEAD", http.MethodHead, func(r *http.Request) { r.Header.Set("Authorization", "Bearer read-token") }, http.StatusNoContent},
+		{"read token POST", http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "Bearer read-token") }, http.StatusForbidden},
+		{"admin token POST", http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-token") }, http.StatusNoContent},
+		{"basic auth", http.MethodPost, func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusNoContent},
+		{"basic auth wrong password", http.MethodGet, func(r *http.Request) { r.SetBasicAuth("alice", "guess") }, http.StatusUnauthorized},
+		{"basic auth unknown user", http.MethodGet, func(r *http.Request) { r.SetBasicAuth("bob", "secret") }, http.StatusUnauthorized},
+		{"forged session", http.MethodGet, func(r *http.Request) { r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "forged"}) }, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(test.method, "/api/status", nil)
+		test.setup(r)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.want)
+		}
+
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing WWW-Authenticate header", test.name)
+		}
+	}
+}
+
+func TestAuthenticatorSession(t *testing.T) {
+	a := testAuthenticator(t)
+
+	handler := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/files/x.mp4", nil)
+	r.SetBasicAuth("alice", "secret")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("expected a session cookie, got %v", cookies)
+	}
+
+	// the session replaces the password on later requests
+	r = httptest.NewRequest(http.MethodPost, "/api/cut", nil)
+	r.AddCookie(cookies[0])
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("session request: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("session request started a new session")
+	}
+}
+
+func TestAuthenticatorSessionReuse(t *testing.T) {
+	a := testAuthenticator(t)
+
+	handler := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// clients which never send the cookie back share the user's session
+	var id string
+	for n := 0; n < 10; n++ {
+		r := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+		r.SetBasicAuth("alice", "secret")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected a session cookie, got %v", cookies)
+		}
+
+		if id == "" {
+			id = cookies[0].Value
+		} else if cookies[0].Value != id {
+			t.Errorf("request %d started a new session", n)
+		}
+	}
+
+	if len(a.sessions) != 1 {
+		t.Errorf("got %d sessions, want 1", len(a.sessions))
+	}
+
+	// an expired session is replaced
+	a.sessions[id].expires = time.Now().Add(-time.Second)
+
+	if next := a.login(a.cfg.Users[0]); next == id || next == "" {
+		t.Error("expired session was reused")
+	}
+
+	if len(a.sessions) != 1 {
+		t.Errorf("got %d sessions, want 1", len(a.sessions))
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"[::]:8080":      false,
+		"192.168.1.2:80": false,
+		"localhost:8080": true,
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"127.0.0.1":      false,
+	} {
+		if got := loopback(addr); got != want {
+			t.Errorf("loopback(%q): got %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	for _, test := range []struct {
+		name string
+		cfg  *AuthConfig
+		ok   bool
+	}{
+		{"nil", nil, true},
+		{"token", &AuthConfig{Tokens: []*APIToken{{Name: "a", Token: "t", Role: RoleRead}}}, true},
+		{"empty token", &AuthConfig{Tokens: []*APIToken{{Name: "a", Role: RoleRead}}}, false},
+		{"unknown role", &AuthConfig{Tokens: []*APIToken{{Name: "a", Token: "t", Role: "root"}}}, false},
+		{"user", &AuthConfig{Users: []*APIUser{{Name: "a", Password: string(hash), Role: RoleAdmin}}}, true},
+		{"plain password", &AuthConfig{Users: []*APIUser{{Name: "a", Password: "secret", Role: RoleAdmin}}}, false},
+	} {
+		if err := test.cfg.Validate(); (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok = %v", test.name, err, test.ok)
+		}
+	}
+}
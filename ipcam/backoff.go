@@ -1,31 +1,96 @@
 package ipcam
 
 import (
-	"math"
+	"errors"
 	"math/rand"
 	"time"
 )
 
-func ExpBackoff(max time.Duration, call func() error) (n int, err error) {
+const (
+	// backoffBase is the wait after the first failed attempt; it doubles after
+	// each one, up to backoffCap
+	backoffBase = time.Second
+	backoffCap  = 5 * time.Minute
+)
+
+// permanentError stops ExpBackoff from retrying
+type permanentError struct {
+	err error
+}
 
-	var i float64
-	var t time.Duration
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
 
-	for i = float64(1); t <= max; i++ {
+// Permanent wraps err so that ExpBackoff returns it without retrying
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// ExpBackoff calls call until it succeeds, waiting exponentially longer between
+// attempts, and gives up once the next wait would exceed max or call returns a
+// Permanent error. It returns the number of attempts and the last error
+func ExpBackoff(max time.Duration, call func() error) (n int, err error) {
+	for n = 1; ; n++ {
 		err = call()
+		if err == nil {
+			return n, nil
+		}
 
-		if err != nil {
-			t = increment(i)
-			time.Sleep(t)
-		} else {
-			return int(i), nil
+		var p *permanentError
+		if errors.As(err, &p) {
+			return n, p.err
 		}
+
+		d := delay(n)
+		if d > max {
+			return n, err
+		}
+
+		backoffAttempts.Inc("")
+
+		time.Sleep(jitter(d))
+	}
+}
+
+func RetryBackoff(attempts int, call func(n int) error) (n int, err error) {
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	for n = 1; n <= attempts; n++ {
+		err = call(n)
+
+		if err == nil {
+			return n, nil
+		}
+
+		if n < attempts {
+			time.Sleep(jitter(delay(n)))
+		}
+	}
+	return attempts, err
+}
+
+// delay returns the wait after the nth failed attempt
+func delay(n int) time.Duration {
+	d := backoffBase
+	for i := 1; i < n && d < backoffCap; i++ {
+		d *= 2
+	}
+
+	if d > backoffCap {
+		return backoffCap
 	}
-	return int(i), err
+	return d
 }
 
-func increment(n float64) time.Duration {
-	return time.Millisecond * time.Duration(
-		int64(math.Pow(2, n))+
-			rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(1000))
+// jitter adds up to a quarter of d, so that clients failing together don't
+// retry together
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/4+1))
 }
@@ -0,0 +1,68 @@
+package ipcam
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	for n, want := range map[int]time.Duration{
+		1:    time.Second,
+		2:    2 * time.Second,
+		3:    4 * time.Second,
+		5:    16 * time.Second,
+		8:    128 * time.Second,
+		9:    256 * time.Second,
+		10:   backoffCap,
+		64:   backoffCap,
+		1000: backoffCap,
+	} {
+		if got := delay(n); got != want {
+			t.Errorf("delay(%d): got %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, d := range []time.Duration{time.Second, 16 * time.Second, backoffCap} {
+		for i := 0; i < 100; i++ {
+			if got := jitter(d); got < d || got > d+d/4 {
+				t.Fatalf("jitter(%v): got %v, want within [%v, %v]", d, got, d, d+d/4)
+			}
+		}
+	}
+}
+
+func TestExpBackoff(t *testing.T) {
+	fail := errors.New("fail")
+
+	n, err := ExpBackoff(time.Hour, func() error { return nil })
+	if n != 1 || err != nil {
+		t.Errorf("success: got (%d, %v), want (1, nil)", n, err)
+	}
+
+	// the first wait (1s) already exceeds the maximum
+	n, err = ExpBackoff(time.Millisecond, func() error { return fail })
+	if n != 1 || err != fail {
+		t.Errorf("failure: got (%d, %v), want (1, %v)", n, err, fail)
+	}
+
+	n, err = ExpBackoff(time.Hour, func() error { return Permanent(fail) })
+	if n != 1 || err != fail {
+		t.Errorf("permanent failure: got (%d, %v), want (1, %v)", n, err, fail)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var calls []int
+
+	n, err := RetryBackoff(0, func(n int) error {
+		calls = append(calls, n)
+		return errors.New("fail")
+	})
+
+	if n != 1 || err == nil || len(calls) != 1 {
+		t.Errorf("got (%d, %v) after %d calls, want a single failed attempt", n, err, len(calls))
+	}
+}
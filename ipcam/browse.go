@@ -0,0 +1,156 @@
+package ipcam
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const filesPrefix = "/files/"
+
+// DayListing summarizes the recordings started on a given day
+type DayListing struct {
+	Date     string `json:"date"`
+	Segments int    `json:"segments"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// SegmentListing describes a recording, with a link to stream it and its
+// metadata sidecar (if any)
+type SegmentListing struct {
+	Camera string       `json:"camera"`
+	Path   string       `json:"path"`
+	URL    string       `json:"url"`
+	Start  time.Time    `json:"start"`
+	End    time.Time    `json:"end"`
+	Bytes  int64        `json:"bytes"`
+	Info   *SegmentInfo `json:"info,omitempty"`
+}
+
+// Days lists the days with recordings for camera (or all cameras, if empty)
+func (s *StreamService) Days(camera string) []*DayListing {
+	days := map[string]*DayListing{}
+
+	for _, e := range s.Index.Query(camera, time.Time{}, time.Time{}) {
+		date := e.Start.In(s.loc).Format(folderLayout)
+
+		day, ok := days[date]
+		if !ok {
+			day = &DayListing{Date: date}
+			days[date] = day
+		}
+
+		day.Segments++
+		day.Bytes += e.Bytes
+	}
+
+	out := make([]*DayListing, 0, len(days))
+	for _, day := range days {
+		out = append(out, day)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Date < out[j].Date
+	})
+
+	return out
+}
+
+// Segments lists the recordings for camera (or all cameras, if empty) started on
+// date, formatted as YYYY-MM-DD
+func (s *StreamService) Segments(camera, date string) ([]*SegmentListing, error) {
+	from, err := time.ParseInLocation(folderLayout, date, s.loc)
+	if err != nil {
+		return nil, err
+	}
+	to := nextMidnight(from)
+
+	out := []*SegmentListing{}
+
+	for _, e := range s.Index.Query(camera, from, to) {
+		if e.Start.Before(from) {
+			continue
+		}
+
+		rel, err := filepath.Rel(s.request.OutDir, e.Path)
+		if err != nil {
+			continue
+		}
+
+		seg := &SegmentListing{
+			Camera: e.Camera,
+			Path:   filepath.ToSlash(rel),
+			URL:    (&url.URL{Path: filesPrefix + filepath.ToSlash(rel)}).String(),
+			Start:  e.Start,
+			End:    e.End,
+			Bytes:  e.Bytes,
+		}
+
+		if info, err := ReadSegmentInfo(sidecarPath(e.Path)); err == nil {
+			seg.Info = info
+		}
+
+		out = append(out, seg)
+	}
+
+	return out, nil
+}
+
+var errNotFound = errors.New("file not found")
+
+// recordingFile resolves a slash-separated path, relative to the output
+// directory, to a recording or its sidecar. Paths outside of the output
+// directory, hidden (e.g. partial) files, the service's own files and folders,
+// and anything not named by the output layout are refused
+func (s *StreamService) recordingFile(rel string) (string, error) {
+	rel = strings.TrimPrefix(rel, "/")
+
+	for _, name := range strings.Split(rel, "/") {
+		if name == "" || name == ".." || strings.HasPrefix(name, ".") || reserved[name] {
+			return "", errNotFound
+		}
+	}
+
+	path := filepath.Join(s.request.OutDir, filepath.FromSlash(rel))
+
+	// the layout ignores extensions, so this matches recordings and sidecars
+	if _, ok := s.layout.Parse(s.request.OutDir, path); !ok {
+		return "", errNotFound
+	}
+
+	return path, nil
+}
+
+// serveFile streams a recording; http.ServeContent handles range requests so
+// that players can seek
+func (s *StreamService) serveFile(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+
+	path, err := s.recordingFile(strings.TrimPrefix(r.URL.Path, filesPrefix))
+	if err != nil {
+		writeResponse(w, http.StatusNotFound, &apiError{Error: err.Error()})
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		writeResponse(w, http.StatusNotFound, &apiError{Error: errNotFound.Error()})
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		writeResponse(w, http.StatusNotFound, &apiError{Error: errNotFound.Error()})
+		return
+	}
+
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+}
@@ -0,0 +1,67 @@
+package ipcam
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeFile(t *testing.T) {
+	root := t.TempDir()
+
+	for _, rel := range []string{
+		"2022-05-30/2022-05-30-14-05-09Z.mp4",
+		"2022-05-30/2022-05-30-14-05-09Z.json",
+		"2022-05-30/notes.txt",
+		"2022-05-30/.2022-05-30-15-00-00Z.partial.mp4",
+		indexFile,
+		protectFile,
+		webhookLog,
+		"failed/2022-05-30-14-05-09Z/report.json",
+		exportDir + "/2022-05-30-14-05-09Z.mp4",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layout, err := ParseLayout(DefaultLayout, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := testService("cam")
+	s.request.OutDir = root
+	s.layout = layout
+
+	for path, want := range map[string]int{
+		"2022-05-30/2022-05-30-14-05-09Z.mp4":          http.StatusOK,
+		"2022-05-30/2022-05-30-14-05-09Z.json":         http.StatusOK,
+		"2022-05-30/2022-05-30-16-00-00Z.mp4":          http.StatusNotFound,
+		"2022-05-30/notes.txt":                         http.StatusNotFound,
+		"2022-05-30/.2022-05-30-15-00-00Z.partial.mp4": http.StatusNotFound,
+		indexFile:   http.StatusNotFound,
+		protectFile: http.StatusNotFound,
+		webhookLog:  http.StatusNotFound,
+		"failed/2022-05-30-14-05-09Z/report.json":           http.StatusNotFound,
+		exportDir + "/2022-05-30-14-05-09Z.mp4":             http.StatusNotFound,
+		"2022-05-30/../2022-05-30/2022-05-30-14-05-09Z.mp4": http.StatusNotFound,
+	} {
+		r := httptest.NewRequest(http.MethodGet, filesPrefix+path, nil)
+		w := httptest.NewRecorder()
+
+		s.serveFile(w, r)
+
+		if w.Code != want {
+			t.Errorf("%s: got status %d, want %d", path, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package ipcam
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotRecording     = errors.New("recording is stopped")
+	ErrAlreadyRecording = errors.New("recording is already running")
+	ErrAlreadyStopped   = errors.New("recording is already stopped")
+	ErrShuttingDown     = errors.New("recorder is shutting down")
+)
+
+// control holds the capture loop's runtime state, shared with the HTTP API
+type control struct {
+	mu       sync.Mutex
+	stopped  bool
+	resume   chan struct{}
+	cut      chan struct{}
+	stream   *SplitStream
+	output   string
+	start    time.Time
+	deadline time.Time
+	pending  map[*SplitStream]PendingMerge
+
+	// parked is set while the capture loop is blocked in wait; closing refuses
+	// Start once shutdown has begun
+	parked  bool
+	closing bool
+	changed *sync.Cond
+}
+
+func newControl() *control {
+	c := &control{
+		pending: map[*SplitStream]PendingMerge{},
+	}
+	c.changed = sync.NewCond(&c.mu)
+
+	return c
+}
+
+// wait blocks while recording is stopped
+func (c *control) wait() {
+	for {
+		c.mu.Lock()
+		if !c.stopped {
+			c.parked = false
+			c.mu.Unlock()
+			return
+		}
+		resume := c.resume
+		c.parked = true
+		c.changed.Broadcast()
+		c.mu.Unlock()
+
+		<-resume
+	}
+}
+
+// begin registers stream as the current segment, returning the channel which is
+// closed when the segment must be cut short
+func (c *control) begin(stream *SplitStream, start, deadline time.Time) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stream = stream
+	c.output = stream.outPath
+	c.start = start
+	c.deadline = deadline
+	c.cut = make(chan struct{})
+
+	cut := c.cut
+
+	// stopped while connecting
+	if c.stopped {
+		c.cutLocked()
+	}
+
+	return cut
+}
+
+// end moves the current segment to the pending merges
+func (c *control) end(stream *SplitStream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	output := c.output
+
+	if c.stream == stream {
+		c.stream = nil
+		c.output = ""
+		c.cut = nil
+	}
+
+	// the merge may rename the output, so the path copied in begin is kept
+	c.pending[stream] = PendingMerge{Output: output, Since: time.Now()}
+	c.changed.Broadcast()
+}
+
+func (c *control) merged(stream *SplitStream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, stream)
+	c.changed.Broadcast()
+}
+
+// shutdown stops recording, cutting the current segment, and blocks until the
+// capture loop is parked and every pending merge is done
+func (c *control) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closing = true
+
+	if !c.stopped {
+		c.stopped = true
+		c.resume = make(chan struct{})
+	}
+
+	c.cutLocked()
+
+	for !c.parked || len(c.pending) > 0 {
+		c.changed.Wait()
+	}
+}
+
+func (c *control) cutLocked() {
+	if c.cut != nil {
+		close(c.cut)
+		c.cut = nil
+	}
+}
+
+func (c *control) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return ErrShuttingDown
+	}
+
+	if !c.stopped {
+		return ErrAlreadyRecording
+	}
+
+	c.stopped = false
+	close(c.resume)
+
+	return nil
+}
+
+func (c *control) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return ErrAlreadyStopped
+	}
+
+	c.stopped = true
+	c.resume = make(chan struct{})
+	c.cutLocked()
+
+	return nil
+}
+
+// Cut ends the current segment early; recording continues with a new segment
+func (c *control) Cut() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return ErrNotRecording
+	}
+
+	c.cutLocked()
+
+	return nil
+}
+
+// Status describes the state of the recorder
+type Status struct {
+	Camera    string         `json:"camera"`
+	Recording bool           `json:"recording"`
+	Degraded  bool           `json:"degraded"`
+	Segment   *SegmentStatus `json:"segment,omitempty"`
+	Pending   []PendingMerge `json:"pendingMerges"`
+	Viewers   int            `json:"liveViewers"`
+}
+
+type SegmentStatus struct {
+	Output   string      `json:"output"`
+	Start    time.Time   `json:"start"`
+	Deadline time.Time   `json:"deadline"`
+	Video    TrackStatus `json:"video"`
+	Audio    TrackStatus `json:"audio"`
+}
+
+type TrackStatus struct {
+	URL       string   `json:"url"`
+	Connected bool     `json:"connected"`
+	Bytes     int64    `json:"bytes"`
+	Frames    int64    `json:"frames,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+type PendingMerge struct {
+	Output string    `json:"output"`
+	Since  time.Time `json:"since"`
+}
+
+func (s *Stream) status() TrackStatus {
+	return TrackStatus{
+		URL:       s.URL(),
+		Connected: s.Connected(),
+		Bytes:     s.Bytes(),
+		Frames:    s.Frames(),
+		Errors:    s.Errors(),
+	}
+}
+
+func (c *control) status() *Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := &Status{
+		Recording: !c.stopped,
+		Pending:   []PendingMerge{},
+	}
+
+	// the tracks' state is read through their atomic and locked accessors
+	if c.stream != nil {
+		status.Segment = &SegmentStatus{
+			Output:   c.output,
+			Start:    c.start,
+			Deadline: c.deadline,
+			Video:    c.stream.video.status(),
+			Audio:    c.stream.audio.status(),
+		}
+	}
+
+	for _, merge := range c.pending {
+		status.Pending = append(status.Pending, merge)
+	}
+
+	sort.Slice(status.Pending, func(i, j int) bool {
+		return status.Pending[i].Since.Before(status.Pending[j].Since)
+	})
+
+	return status
+}
+
+// Status returns the current state of the recorder
+func (s *StreamService) Status() *Status {
+	status := s.control.status()
+	status.Camera = s.request.Camera
+	status.Degraded = s.guard.Degraded()
+	status.Viewers = s.live.Viewers()
+
+	return status
+}
+
+// StartRecording resumes a stopped recorder
+func (s *StreamService) StartRecording() error {
+	if err := s.control.Start(); err != nil {
+		return err
+	}
+
+	s.Events.publish(&Event{Type: EventRecording})
+	return nil
+}
+
+// StopRecording ends the current segment (which is merged as usual) and pauses
+// the recorder until StartRecording is called
+func (s *StreamService) StopRecording() error {
+	if err := s.control.Stop(); err != nil {
+		return err
+	}
+
+	s.Events.publish(&Event{Type: EventPaused})
+	return nil
+}
+
+// CutSegment ends the current segment early and starts a new one
+func (s *StreamService) CutSegment() error {
+	return s.control.Cut()
+}
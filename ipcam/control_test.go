@@ -0,0 +1,86 @@
+package ipcam
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestControlShutdown(t *testing.T) {
+	c := newControl()
+
+	stream := &SplitStream{
+		audio:   &Stream{name: "audio"},
+		video:   &Stream{name: "video"},
+		outPath: "/out/segment.mp4",
+	}
+
+	cut := c.begin(stream, time.Now(), time.Now().Add(time.Hour))
+
+	if status := c.status(); status.Segment == nil || status.Segment.Output != "/out/segment.mp4" {
+		t.Fatalf("unexpected segment status %+v", status.Segment)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-cut:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't cut the segment")
+	}
+
+	// the capture loop: the segment ends and its merge runs, then the loop parks
+	c.end(stream)
+	go c.wait()
+
+	select {
+	case <-done:
+		t.Fatal("shutdown returned with a pending merge")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.merged(stream)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't return after the merge")
+	}
+
+	if err := c.Start(); err != ErrShuttingDown {
+		t.Errorf("Start after shutdown: got %v, want %v", err, ErrShuttingDown)
+	}
+}
+
+func TestMergeEmptySegment(t *testing.T) {
+	dir := t.TempDir()
+
+	stream := &SplitStream{
+		audio:   &Stream{name: "audio", outPath: filepath.Join(dir, "a.mp4")},
+		video:   &Stream{name: "video", outPath: filepath.Join(dir, "v.mp4")},
+		outPath: filepath.Join(dir, "out.mp4"),
+		retries: 3,
+	}
+
+	for _, path := range []string{stream.audio.outPath, stream.video.outPath} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream.Merge("25")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 || stream.attempts != 0 {
+		t.Errorf("empty segment was merged: %d attempts, files left: %v", stream.attempts, entries)
+	}
+}
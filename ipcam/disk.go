@@ -0,0 +1,39 @@
+//go:build !windows
+
+package ipcam
+
+import "syscall"
+
+type DiskUsage struct {
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	Used  uint64 `json:"used"`
+}
+
+func diskUsage(path string) (*DiskUsage, error) {
+	st := &syscall.Statfs_t{}
+
+	if err := syscall.Statfs(path, st); err != nil {
+		return nil, err
+	}
+
+	total := uint64(st.Blocks) * uint64(st.Bsize)
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+
+	return &DiskUsage{
+		Total: total,
+		Free:  free,
+		Used:  total - uint64(st.Bfree)*uint64(st.Bsize),
+	}, nil
+}
+
+// device returns the ID of the filesystem holding path
+func device(path string) (uint64, error) {
+	st := &syscall.Stat_t{}
+
+	if err := syscall.Stat(path, st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Dev), nil
+}
@@ -0,0 +1,17 @@
+package ipcam
+
+import "errors"
+
+type DiskUsage struct {
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	Used  uint64 `json:"used"`
+}
+
+func diskUsage(path string) (*DiskUsage, error) {
+	return nil, errors.New("disk usage is not supported on windows")
+}
+
+func device(path string) (uint64, error) {
+	return 0, errors.New("filesystem IDs are not supported on windows")
+}
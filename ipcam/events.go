@@ -0,0 +1,199 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+type EventType string
+
+const (
+	EventSegmentStarted  EventType = "segment.started"
+	EventSegmentFinished EventType = "segment.finished"
+	EventMerged          EventType = "segment.merged"
+	EventMergeFailed     EventType = "segment.failed"
+	EventReconnecting    EventType = "stream.reconnecting"
+	EventOffline         EventType = "camera.offline"
+	EventOnline          EventType = "camera.online"
+	EventStalled         EventType = "stream.stalled"
+	EventDiskLow         EventType = "disk.low"
+	EventDiskCritical    EventType = "disk.critical"
+	EventRotated         EventType = "retention.rotated"
+	EventRecording       EventType = "recording.started"
+	EventPaused          EventType = "recording.stopped"
+)
+
+var knownEvents = map[EventType]bool{
+	EventSegmentStarted:  true,
+	EventSegmentFinished: true,
+	EventMerged:          true,
+	EventMergeFailed:     true,
+	EventReconnecting:    true,
+	EventOffline:         true,
+	EventOnline:          true,
+	EventStalled:         true,
+	EventDiskLow:         true,
+	EventDiskCritical:    true,
+	EventRotated:         true,
+	EventRecording:       true,
+	EventPaused:          true,
+}
+
+// Event describes something that happened in the recorder. Only the fields
+// relevant to its type are set
+type Event struct {
+	Type   EventType `json:"type"`
+	Time   time.Time `json:"time"`
+	Camera string    `json:"camera,omitempty"`
+
+	// Output is the segment's output file, for segment and stream events
+	Output string `json:"output,omitempty"`
+	// Track is the stream ("audio" or "video"), for stream events
+	Track string `json:"track,omitempty"`
+	// Reason tells why a segment finished ("deadline" or "cut")
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Path and Bytes are the directory low on space and the bytes needed to
+	// reach the minimum free space, for disk events
+	Path  string `json:"path,omitempty"`
+	Bytes int64  `json:"bytes,omitempty"`
+
+	Segment   *SegmentInfo     `json:"segment,omitempty"`
+	Retention *RetentionReport `json:"retention,omitempty"`
+}
+
+const eventBuffer = 64
+
+// EventBus delivers the recorder's events to its subscribers. Delivery never
+// blocks the recorder: a subscriber which falls behind misses events, which are
+// logged and counted in the ipcam_events_dropped_total metric.
+//
+// Each subscriber receives its own copy of an event, so it may keep or modify it
+type EventBus struct {
+	mu      sync.Mutex
+	camera  string
+	subs    map[chan *Event]string
+	offline map[string]bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs:    map[chan *Event]string{},
+		offline: map[string]bool{},
+	}
+}
+
+// Subscribe returns a channel receiving the events, and a function to
+// unsubscribe (which closes the channel). The name identifies the subscriber
+// when its events are dropped
+func (b *EventBus) Subscribe(name string) (<-chan *Event, func()) {
+	ch := make(chan *Event, eventBuffer)
+
+	b.mu.Lock()
+	b.subs[ch] = name
+	b.mu.Unlock()
+
+	var once sync.Once
+
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+
+			close(ch)
+		})
+	}
+}
+
+// Handle calls fn for each event, in order, from a separate goroutine. It
+// returns a function to unsubscribe
+func (b *EventBus) Handle(name string, fn func(*Event)) func() {
+	events, unsubscribe := b.Subscribe(name)
+
+	go func() {
+		defer logPanics("EventBus.Handle()")
+
+		for e := range events {
+			fn(e)
+		}
+	}()
+
+	return unsubscribe
+}
+
+// publish sends e to the subscribers; it's a no-op on a nil bus
+func (b *EventBus) publish(e *Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Camera == "" {
+		e.Camera = b.camera
+	}
+
+	for ch, name := range b.subs {
+		select {
+		case ch <- e.clone():
+		default:
+			eventsDropped.Inc(name)
+
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("EventBus.publish()").Message("event subscriber is falling behind -- dropped event").Metadata(log.Field{"subscriber": name, "event": e.Type}).Build()
+		}
+	}
+}
+
+// trackDown publishes a camera.offline event when track fails to connect, unless
+// it's already offline, reporting whether it did
+func (b *EventBus) trackDown(track string, err error) bool {
+	if b == nil || !b.setOffline(track, true) {
+		return false
+	}
+
+	b.publish(&Event{Type: EventOffline, Track: track, Error: err.Error()})
+	return true
+}
+
+// trackUp publishes a camera.online event when track connects after being offline
+func (b *EventBus) trackUp(track string) {
+	if b == nil || !b.setOffline(track, false) {
+		return
+	}
+
+	b.publish(&Event{Type: EventOnline, Track: track})
+}
+
+// setOffline sets the track's state, reporting whether it changed
+func (b *EventBus) setOffline(track string, offline bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.offline[track] == offline {
+		return false
+	}
+
+	b.offline[track] = offline
+	return true
+}
+
+// clone returns a deep copy of e, which shares no state with the recorder
+func (e *Event) clone() *Event {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return &Event{Type: e.Type, Time: e.Time, Camera: e.Camera, Error: err.Error()}
+	}
+
+	c := &Event{}
+	json.Unmarshal(data, c)
+
+	return c
+}
@@ -0,0 +1,83 @@
+package ipcam
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBusCopies(t *testing.T) {
+	bus := NewEventBus()
+	bus.camera = "front"
+
+	a, unsubscribeA := bus.Subscribe("a")
+	defer unsubscribeA()
+	b, unsubscribeB := bus.Subscribe("b")
+	defer unsubscribeB()
+
+	info := &SegmentInfo{Output: "out.mp4", Errors: []string{"first"}}
+	bus.publish(&Event{Type: EventMerged, Segment: info})
+
+	ea, eb := <-a, <-b
+
+	if ea.Camera != "front" || ea.Time.IsZero() {
+		t.Errorf("event camera and time not set: %+v", ea)
+	}
+
+	ea.Segment.Output = "changed"
+	ea.Segment.Errors[0] = "changed"
+
+	if eb.Segment.Output != "out.mp4" || eb.Segment.Errors[0] != "first" {
+		t.Errorf("subscribers share the event: %+v", eb.Segment)
+	}
+
+	if info.Output != "out.mp4" || info.Errors[0] != "first" {
+		t.Errorf("subscriber modified the recorder's state: %+v", info)
+	}
+}
+
+func TestEventBusDrops(t *testing.T) {
+	bus := NewEventBus()
+
+	_, unsubscribe := bus.Subscribe("slow")
+	defer unsubscribe()
+
+	before := eventsDropped.values["slow"]
+
+	for i := 0; i < eventBuffer+3; i++ {
+		bus.publish(&Event{Type: EventSegmentStarted})
+	}
+
+	if got := eventsDropped.values["slow"] - before; got != 3 {
+		t.Errorf("got %v dropped events, want 3", got)
+	}
+}
+
+func TestEventBusHandle(t *testing.T) {
+	bus := NewEventBus()
+
+	got := make(chan EventType, 2)
+	unsubscribe := bus.Handle("test", func(e *Event) {
+		got <- e.Type
+	})
+
+	bus.publish(&Event{Type: EventRecording})
+	bus.publish(&Event{Type: EventPaused})
+
+	for _, want := range []EventType{EventRecording, EventPaused} {
+		select {
+		case e := <-got:
+			if e != want {
+				t.Errorf("got event %s, want %s", e, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+
+	unsubscribe()
+	unsubscribe()
+
+	if len(bus.subs) != 0 {
+		t.Errorf("subscriber not removed")
+	}
+}
@@ -0,0 +1,230 @@
+package ipcam
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+	"github.com/zalgonoise/zlog/log"
+)
+
+const exportDir = "exports"
+
+type ExportManifest struct {
+	Output  string          `json:"output"`
+	Camera  string          `json:"camera,omitempty"`
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	Length  float64         `json:"length"`
+	Sources []*ExportSource `json:"sources"`
+	Created time.Time       `json:"created"`
+}
+
+type ExportSource struct {
+	Path   string    `json:"path"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Offset float64   `json:"offset"`
+	Length float64   `json:"length"`
+}
+
+// ExportPath returns the default path for an exported clip in the output directory root
+func ExportPath(root, camera string, from, to time.Time, ext string) string {
+	name := from.Format(fileLayout) + "_" + to.Format(fileLayout) + ext
+	if camera != "" {
+		name = camera + "_" + name
+	}
+
+	return filepath.Join(root, exportDir, name)
+}
+
+// Export concatenates and trims the indexed recordings for camera which overlap
+// the time range [from, to) into a single clip, written to output along with a
+// JSON manifest of the source files
+func Export(idx *Index, camera string, from, to time.Time, output string) (*ExportManifest, error) {
+	// recordings from different cameras can't be concatenated into one clip
+	if camera == "" {
+		return nil, errors.New("export requires a camera name")
+	}
+
+	if from.IsZero() || to.IsZero() {
+		return nil, errors.New("export requires both the start and the end of the range")
+	}
+
+	if !from.Before(to) {
+		return nil, errors.New("export range start must be before its end")
+	}
+
+	entries := exportEntries(idx, camera, from, to)
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no recordings found between %s and %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	manifest := &ExportManifest{
+		Output: output,
+		Camera: camera,
+		From:   from,
+		To:     to,
+	}
+
+	// recordings are concatenated back to back, so the clip's length is the sum
+	// of the overlaps; any gap between recordings is skipped
+	var length float64
+
+	for _, e := range entries {
+		src := exportSource(e, from, to, recordingDuration(e))
+		if src == nil {
+			continue
+		}
+
+		length += src.Length
+
+		manifest.Sources = append(manifest.Sources, src)
+	}
+
+	if len(manifest.Sources) == 0 {
+		return nil, fmt.Errorf("no recorded video found between %s and %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	manifest.Length = length
+
+	logCh <- log.NewMessage().Sub("Export()").Message("exporting time range").Metadata(log.Field{
+		"camera":  camera,
+		"from":    from,
+		"to":      to,
+		"output":  output,
+		"sources": len(manifest.Sources),
+	}).Build()
+
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return nil, err
+	}
+
+	list, err := os.CreateTemp(filepath.Dir(output), ".export-*.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(list.Name())
+
+	if err := writeConcatList(list, manifest.Sources); err != nil {
+		list.Close()
+		return nil, err
+	}
+
+	if err := list.Close(); err != nil {
+		return nil, err
+	}
+
+	partial := partialPath(output)
+
+	err = ffmpeg.Input(
+		list.Name(),
+		ffmpeg.KwArgs{"f": "concat", "safe": "0"},
+	).Output(
+		partial,
+		ffmpeg.KwArgs{"c:v": "libx264", "c:a": "aac", "pix_fmt": "yuv420p"},
+	).OverWriteOutput().ErrorToStdOut().Run()
+	if err != nil {
+		os.Remove(partial)
+
+		logCh <- log.NewMessage().Level(log.LLError).Sub("Export()").Message("failed to export time range").Metadata(log.Field{"output": output, "error": err.Error()}).Build()
+
+		return nil, err
+	}
+
+	if err := verifyPartial(partial); err != nil {
+		os.Remove(partial)
+		return nil, err
+	}
+
+	if manifest.Output, err = commitFile(partial, output); err != nil {
+		return nil, err
+	}
+
+	manifest.Created = time.Now()
+
+	if err := writeJSON(sidecarPath(manifest.Output), manifest); err != nil {
+		return nil, err
+	}
+
+	logCh <- log.NewMessage().Sub("Export()").Message("exported time range").Metadata(log.Field{"output": manifest.Output, "length": manifest.Length}).Build()
+
+	return manifest, nil
+}
+
+// exportEntries returns the indexed recordings for camera overlapping [from, to).
+// Recordings from before camera names were recorded have none, and are taken as
+// the camera's, as the recorder only kept one camera's recordings then
+func exportEntries(idx *Index, camera string, from, to time.Time) []*IndexEntry {
+	var entries []*IndexEntry
+
+	for _, e := range idx.Query("", from, to) {
+		if e.Camera == camera || e.Camera == "" {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// recordingDuration probes the length of the recorded video, which can be shorter
+// than the time between the recording's start and end (e.g. when the stream
+// dropped), falling back to the latter if the recording can't be probed
+func recordingDuration(e *IndexEntry) time.Duration {
+	res, err := probe(e.Path, 0)
+	if err != nil || res.Duration <= 0 {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("Export()").Message("unable to probe recording -- using its indexed times").Metadata(log.Field{"path": e.Path, "error": fmt.Sprint(err)}).Build()
+
+		return e.End.Sub(e.Start)
+	}
+
+	return time.Duration(res.Duration * float64(time.Second))
+}
+
+// exportSource returns the part of the recording e, holding duration of video,
+// within [from, to); or nil if there is none
+func exportSource(e *IndexEntry, from, to time.Time, duration time.Duration) *ExportSource {
+	start, end := e.Start, e.Start.Add(duration)
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+
+	if !start.Before(end) {
+		return nil
+	}
+
+	return &ExportSource{
+		Path:   e.Path,
+		Start:  e.Start,
+		End:    e.End,
+		Offset: start.Sub(e.Start).Seconds(),
+		Length: end.Sub(start).Seconds(),
+	}
+}
+
+// writeConcatList writes the ffmpeg concat demuxer list for sources, trimming
+// each file to its own part of the range with inpoint and outpoint
+func writeConcatList(w io.Writer, sources []*ExportSource) error {
+	for _, src := range sources {
+		abs, err := filepath.Abs(src.Path)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "file '%s'\ninpoint %.3f\noutpoint %.3f\n",
+			strings.ReplaceAll(abs, "'", `'\''`), src.Offset, src.Offset+src.Length)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package ipcam
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestExportSource(t *testing.T) {
+	start := time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC)
+
+	// 10:00 to 10:30, a gap, 10:40 to 11:10 with only 20 minutes of video
+	first := &IndexEntry{Camera: "front", Path: "/out/a.mp4", Start: start, End: start.Add(30 * time.Minute)}
+	second := &IndexEntry{Camera: "front", Path: "/out/b.mp4", Start: start.Add(40 * time.Minute), End: start.Add(70 * time.Minute)}
+
+	from, to := start.Add(20*time.Minute), start.Add(55*time.Minute)
+
+	for _, test := range []struct {
+		name     string
+		entry    *IndexEntry
+		duration time.Duration
+		offset   float64
+		length   float64
+		none     bool
+	}{
+		{"starts before the range", first, 30 * time.Minute, 1200, 600, false},
+		{"ends after the range", second, 30 * time.Minute, 0, 900, false},
+		{"shorter video than indexed", second, 10 * time.Minute, 0, 600, false},
+		{"video ends before the range", first, 15 * time.Minute, 0, 0, true},
+	} {
+		src := exportSource(test.entry, from, to, test.duration)
+
+		if test.none {
+			if src != nil {
+				t.Errorf("%s: got %+v, want none", test.name, src)
+			}
+			continue
+		}
+
+		if src == nil || src.Offset != test.offset || src.Length != test.length {
+			t.Errorf("%s: got %+v, want offset %v and length %v", test.name, src, test.offset, test.length)
+		}
+	}
+}
+
+func TestWriteConcatList(t *testing.T) {
+	sources := []*ExportSource{
+		{Path: "/out/a.mp4", Offset: 1200, Length: 600},
+		// after a gap, the next file starts at its own inpoint
+		{Path: "/out/it's.mp4", Offset: 0, Length: 900.5},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeConcatList(buf, sources); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "file '" + filepath.FromSlash("/out/a.mp4") + "'\ninpoint 1200.000\noutpoint 1800.000\n" +
+		"file '" + filepath.FromSlash("/out/it'\\''s.mp4") + "'\ninpoint 0.000\noutpoint 900.500\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExportEntries(t *testing.T) {
+	start := time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC)
+
+	idx := newIndex(t.TempDir(), nil)
+	idx.add(&IndexEntry{Camera: "front", Path: "front.mp4", Start: start, End: start.Add(time.Hour)})
+	idx.add(&IndexEntry{Camera: "back", Path: "back.mp4", Start: start, End: start.Add(time.Hour)})
+	// indexed before camera names were recorded
+	idx.add(&IndexEntry{Path: "legacy.mp4", Start: start.Add(-time.Hour), End: start})
+
+	entries := exportEntries(idx, "front", start.Add(-time.Hour), start.Add(time.Hour))
+
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+
+	sort.Strings(paths)
+
+	if !reflect.DeepEqual(paths, []string{"front.mp4", "legacy.mp4"}) {
+		t.Errorf("got %v, want the camera's and the legacy recordings", paths)
+	}
+}
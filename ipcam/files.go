@@ -1,8 +1,14 @@
 package ipcam
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/zalgonoise/zlog/log"
@@ -39,8 +45,8 @@ func (c *cache) clear() []error {
 	var errs []error
 
 	for _, file := range c.files {
-		if err := os.RemoveAll(c.root + file); err != nil {
-			logCh <- log.NewMessage().Level(log.LLWarn).Sub("clear()").Message("failed to remove target file").Metadata(log.Field{"path": c.root + file, "error": err.Error()}).Build()
+		if err := os.RemoveAll(filepath.Join(c.root, file)); err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("clear()").Message("failed to remove target file").Metadata(log.Field{"path": filepath.Join(c.root, file), "error": err.Error()}).Build()
 
 			errs = append(errs, err)
 		}
@@ -50,82 +56,239 @@ func (c *cache) clear() []error {
 
 }
 
-type dir struct {
-	root string
-	dirs []string
+// reserved lists the names in the output directory which aren't dated folders
+var reserved = map[string]bool{
+	"cache":     true,
+	"failed":    true,
+	exportDir:   true,
+	indexFile:   true,
+	protectFile: true,
+	webhookLog:  true,
 }
 
-func (d *dir) load(path string) error {
+// removeEmptyDirs removes path and its parents while they are empty, up to root
+func removeEmptyDirs(root, path string) {
+	root = filepath.Clean(root)
 
-	var err error
+	for path = filepath.Clean(path); path != root && strings.HasPrefix(path, root); path = filepath.Dir(path) {
+		if err := os.Remove(path); err != nil {
+			return
+		}
+	}
+}
 
-	d.dirs, err = fs.Glob(os.DirFS(path), "*")
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
 
+	// rename fails across filesystems; fall back to copy and remove
+	in, err := os.Open(src)
 	if err != nil {
-		logCh <- log.NewMessage().Level(log.LLWarn).Sub("load()").Message("failed to parse glob path").Metadata(log.Field{"path": path, "error": err.Error()}).Build()
+		return err
+	}
+	defer in.Close()
 
+	out, err := os.Create(dst)
+	if err != nil {
 		return err
 	}
 
-	d.root = path
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
 
-	return nil
+	if err := out.Close(); err != nil {
+		return err
+	}
 
+	return os.Remove(src)
 }
 
-func (d *dir) exists(name string) bool {
-	for _, dir := range d.dirs {
-		if name == dir {
-			return true
+const partialSuffix = ".partial"
+
+// partialStale is how long a partial file goes unmodified before it's
+// considered left over from an interrupted merge, rather than one in progress
+// (e.g. from another camera sharing the output directory)
+const partialStale = 10 * time.Minute
+
+// clearPartials removes the stale partial files under root, left behind by
+// merges interrupted by a crash. Only files named by partialPath, for a target
+// which the layout accepts, are removed; reserved folders are skipped
+func clearPartials(root string, layout *Layout) []error {
+	var errs []error
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
 		}
+
+		if entry.IsDir() {
+			if path != root && reserved[entry.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target, ok := partialTarget(path)
+		if !ok {
+			return nil
+		}
+
+		if _, ok := layout.Parse(root, target); !ok {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < partialStale {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("clearPartials()").Message("failed to remove partial file").Metadata(log.Field{"path": path, "error": err.Error()}).Build()
+
+			errs = append(errs, err)
+			return nil
+		}
+
+		logCh <- log.NewMessage().Sub("clearPartials()").Message("removed stale partial file").Metadata(log.Field{"path": path}).Build()
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
 	}
-	return false
+
+	return errs
 }
 
-func (d *dir) mkdir(name string) error {
-	return os.Mkdir(d.root+name, 0755)
+// partialTarget reverses partialPath, returning the output a partial file
+// stands for, if path is named like one
+func partialTarget(path string) (string, bool) {
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+
+	if len(name) <= len("."+partialSuffix) || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, partialSuffix) {
+		return "", false
+	}
+
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "."), partialSuffix)
+
+	return filepath.Join(filepath.Dir(path), name+ext), true
 }
 
-func (d *dir) listOlder(from time.Time, days int) ([]string, []error) {
-	var older []string
-	var errs []error
+func partialPath(path string) string {
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), ext)
 
-	day := time.Duration(24 * time.Hour)
+	// keep the extension last so that ffmpeg can still infer the container
+	return filepath.Join(filepath.Dir(path), "."+name+partialSuffix+ext)
+}
 
-	tresh := from.Add(time.Duration(-days) * day)
+func verifyPartial(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
 
-	for _, folder := range d.dirs {
-		if folder == "cache" {
-			continue
+	if info.Size() == 0 {
+		return errors.New("merged output file is empty")
+	}
+
+	return nil
+}
+
+// linkFile hard-links files; a variable so that tests can take the fallback
+// used where hard links aren't supported
+var linkFile = os.Link
+
+// commitFile atomically moves the partial file into place, without replacing an
+// existing recording. If the target exists, a numeric suffix is added to its name
+func commitFile(partial, target string) (string, error) {
+	ext := filepath.Ext(target)
+	base := strings.TrimSuffix(target, ext)
+
+	for i := 0; i < 100; i++ {
+		out := target
+		if i > 0 {
+			out = fmt.Sprintf("%s-%d%s", base, i, ext)
 		}
 
-		t, err := time.Parse("2006-01-02", folder)
-		if err != nil {
-			logCh <- log.NewMessage().Level(log.LLWarn).Sub("listOlder()").Message("failed to parse folder name").Metadata(log.Field{"target": folder, "error": err.Error()}).Build()
+		err := linkFile(partial, out)
+		if err == nil {
+			return out, os.Remove(partial)
+		}
 
-			errs = append(errs, err)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+
+		// hard links aren't supported everywhere: claim the name with an exclusive
+		// create instead, and rename the partial file over the empty claim
+		claim, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
 			continue
 		}
-		if t.Before(tresh) {
-			older = append(older, folder)
+		if err != nil {
+			return out, err
 		}
+		claim.Close()
+
+		if err := os.Rename(partial, out); err != nil {
+			os.Remove(out)
+			return out, err
+		}
+
+		return out, nil
+	}
+
+	return "", fmt.Errorf("unable to find a free output name for %s", target)
+}
 
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
 	}
-	return older, errs
+
+	return os.WriteFile(path, data, 0644)
 }
 
-func (d *dir) rotate(from time.Time, days int) {
-	targets, errs := d.listOlder(from, days)
+// writeJSONAtomic writes v to a temporary file first, replacing path on success.
+// Each write has its own temporary file, so concurrent writers don't clash
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
 
-	for _, target := range targets {
-		if err := os.RemoveAll(d.root + target); err != nil {
-			logCh <- log.NewMessage().Level(log.LLWarn).Sub("rotate()").Message("failed to remove old stream files").Metadata(log.Field{"target": d.root + target, "error": err.Error()}).Build()
-		}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*"+partialSuffix)
+	if err != nil {
+		return err
 	}
 
-	if len(errs) > 0 {
-		for _, err := range errs {
-			logCh <- log.NewMessage().Level(log.LLWarn).Sub("rotate()").Message("failed to list stream files").Metadata(log.Field{"error": err.Error()}).Build()
-		}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
 	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// CreateTemp only grants access to its owner
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,234 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPartialPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/out/2022-05-30/2022-05-30-14-05-09Z.mp4": "/out/2022-05-30/.2022-05-30-14-05-09Z.partial.mp4",
+		"/out/index.json":                          "/out/.index.partial.json",
+		"/out/clip":                                "/out/.clip.partial",
+	} {
+		if got := partialPath(path); got != filepath.FromSlash(want) {
+			t.Errorf("partialPath(%q): got %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestCommitFile(t *testing.T) {
+	t.Run("link", testCommitFile)
+
+	// filesystems without hard links
+	t.Run("rename", func(t *testing.T) {
+		link := linkFile
+		defer func() { linkFile = link }()
+
+		linkFile = func(string, string) error {
+			return &os.LinkError{Op: "link", Err: syscall.EPERM}
+		}
+
+		testCommitFile(t)
+	})
+}
+
+func testCommitFile(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		existing []string
+		want     string
+	}{
+		{"free", nil, "segment.mp4"},
+		{"taken", []string{"segment.mp4"}, "segment-1.mp4"},
+		{"taken twice", []string{"segment.mp4", "segment-1.mp4"}, "segment-2.mp4"},
+		{"gap", []string{"segment.mp4", "segment-2.mp4"}, "segment-1.mp4"},
+	} {
+		dir := t.TempDir()
+
+		for _, name := range test.existing {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		target := filepath.Join(dir, "segment.mp4")
+		partial := partialPath(target)
+
+		if err := os.WriteFile(partial, []byte("merged"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := commitFile(partial, target)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if out != filepath.Join(dir, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, filepath.Base(out), test.want)
+		}
+
+		if data, err := os.ReadFile(out); err != nil || string(data) != "merged" {
+			t.Errorf("%s: unexpected output %q (%v)", test.name, data, err)
+		}
+
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Errorf("%s: partial file left behind", test.name)
+		}
+
+		// existing recordings are never replaced
+		for _, name := range test.existing {
+			if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != name {
+				t.Errorf("%s: %s was replaced", test.name, name)
+			}
+		}
+	}
+}
+
+func TestCommitFileConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "segment.mp4")
+
+	outs := make(chan string, 10)
+	for n := 0; n < cap(outs); n++ {
+		partial := filepath.Join(dir, fmt.Sprintf(".segment-%d.partial.mp4", n))
+		if err := os.WriteFile(partial, []byte(partial), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			out, err := commitFile(partial, target)
+			if err != nil {
+				t.Error(err)
+			}
+			outs <- out
+		}()
+	}
+
+	// every merge gets its own name
+	seen := map[string]bool{}
+	for n := 0; n < cap(outs); n++ {
+		out := <-outs
+		if seen[out] {
+			t.Errorf("%s committed twice", filepath.Base(out))
+		}
+		seen[out] = true
+	}
+}
+
+func TestWriteJSONAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.json")
+
+	// e.g. the index saved by a merge while retention updates it
+	errs := make(chan error, 10)
+	for n := 0; n < cap(errs); n++ {
+		go func(n int) {
+			errs <- writeJSONAtomic(path, map[string]int{"n": n})
+		}(n)
+	}
+
+	for n := 0; n < cap(errs); n++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := map[string]int{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Errorf("invalid JSON %q: %v", data, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want only index.json", len(entries))
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("unexpected file mode: %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestClearPartials(t *testing.T) {
+	root := t.TempDir()
+
+	layout, err := ParseLayout(DefaultLayout, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := filepath.Join(root, "2022-05-30")
+
+	stale := partialPath(filepath.Join(day, "2022-05-30-14-00-00Z.mp4"))
+	fresh := partialPath(filepath.Join(day, "2022-05-30-15-00-00Z.mp4"))
+
+	kept := []string{
+		fresh,
+		filepath.Join(day, "2022-05-30-13-00-00Z.mp4"),
+		// not named by partialPath, or not for a recording
+		filepath.Join(root, "notes.partial.txt"),
+		filepath.Join(day, "notes.partial.txt"),
+		filepath.Join(root, ".notes.partial.txt"),
+		filepath.Join(root, "Downloads", ".video.partial.mp4"),
+		// reserved folders are left alone
+		partialPath(filepath.Join(root, "failed", "2022-05-30", "2022-05-30-14-00-00Z.mp4")),
+	}
+
+	old := time.Now().Add(-2 * partialStale)
+
+	for _, path := range append([]string{stale}, kept...) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if path != fresh {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if errs := clearPartials(root, layout); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stale partial file wasn't removed")
+	}
+
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+}
+
+func TestPartialTarget(t *testing.T) {
+	for _, path := range []string{"/out/a.mp4", "/out/2022-05-30/2022-05-30-14-05-09Z.mp4", "/out/a.b.mkv"} {
+		if got, ok := partialTarget(partialPath(path)); !ok || got != filepath.FromSlash(path) {
+			t.Errorf("partialTarget(partialPath(%q)): got %q, %v", path, got, ok)
+		}
+	}
+
+	for _, path := range []string{"/out/a.partial.mp4", "/out/.partial.mp4", "/out/.a.mp4", "/out/a.mp4"} {
+		if got, ok := partialTarget(path); ok {
+			t.Errorf("partialTarget(%q): got %q, want no match", path, got)
+		}
+	}
+}
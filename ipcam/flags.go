@@ -9,88 +9,161 @@ import (
 	"github.com/zalgonoise/zlog/store"
 )
 
+// Flags reads the request from the CLI flags and, with -cfg, from a JSON config
+// file. The flag defaults apply first, then the settings in the config file,
+// then the flags set on the command line (see LoadConfig)
 func (s *StreamService) Flags() *StreamRequest {
+	req := &StreamRequest{}
+
+	flag.StringVar(&req.Camera, "name", "ipcam", "Camera name, used to tag its recordings")
+	flag.IntVar(&req.TimeLen, "len", 60, "Length (in minutes) for each video chunk")
+	flag.StringVar(&req.VideoURL, "vurl", "", "Video's URL endpoint")
+	flag.StringVar(&req.AudioURL, "aurl", "", "Audio's URL endpoint")
+	flag.StringVar(&req.TmpDir, "tmp", "/tmp/", "Temporary directory to place files")
+	flag.StringVar(&req.OutExt, "ext", ".mp4", "Output extension")
+	flag.StringVar(&req.VideoRate, "vrate", "25", "Input framerate of the MJPEG stream")
+	flag.StringVar(&req.Logfile, "log", "/tmp/ipcam-stream.log", "File to register logs")
+	flag.IntVar(&req.Retries, "retries", 3, "Number of merge attempts before moving the cached files to the failed directory")
+	flag.BoolVar(&req.Fallback, "fallback", false, "Use a lighter fallback profile on the last merge attempt")
+	flag.BoolVar(&req.Remerge, "remerge", false, "Keep the cached A/V files, and flag the recording for a re-merge, when the merged file fails verification")
+	flag.IntVar(&req.Align, "align", 0, "Align segment boundaries to the clock, every # minutes from midnight (0 to disable)")
+	flag.StringVar(&req.MinFree, "minfree", "", "Minimum free disk space for the tmp and output directories, in bytes (e.g. 5G) or percent (e.g. 10%)")
+	flag.StringVar(&req.HTTPAddr, "http", "", "Address for the HTTP control and status API (e.g. :8080); disabled if empty")
+	flag.StringVar(&req.TLSCert, "tlscert", "", "TLS certificate file for the HTTP API (PEM)")
+	flag.StringVar(&req.TLSKey, "tlskey", "", "TLS private key file for the HTTP API (PEM)")
+	flag.BoolVar(&req.Insecure, "insecure", false, "Allow the HTTP API to listen on a non-loopback address without credentials")
+	flag.BoolVar(&req.HLS, "hls", false, "Encode the live video as HLS, served by the HTTP API at /live/hls/index.m3u8")
+	flag.IntVar(&req.HLSTime, "hlstime", defaultHLSTime, "Duration of each live HLS segment, in seconds")
+	flag.IntVar(&req.HLSWindow, "hlswindow", defaultHLSWindow, "Number of segments kept in the live HLS playlist")
+
+	RetentionFlags(flag.CommandLine, req)
+
+	inputMQTT := flag.String("mqtt", "", "MQTT broker to publish the recorder's state and events to (e.g. tcp://localhost:1883)")
+	inputHass := flag.Bool("hass", false, "Announce the camera to Home Assistant through MQTT discovery (requires -mqtt)")
+
+	inputCfgFile := flag.String("cfg", "", "Input configuration file (JSON); flags set on the command line override its settings")
 
-	inputLen := flag.Int("len", 60, "Length (in minutes) for each video chunk")
-	inputVideoURL := flag.String("vurl", "", "Video's URL endpoint")
-	inputAudioURL := flag.String("aurl", "", "Audio's URL endpoint")
-	inputTmpDir := flag.String("tmp", "/tmp/", "Temporary directory to place files")
-	inputOutDir := flag.String("out", "~/", "Output directory to place files")
-	inputExtension := flag.String("ext", ".mp4", "Output extension")
-	inputVideoRate := flag.String("vrate", "25", "Input framerate of the MJPEG stream")
-	inputRotate := flag.Int("rotate", 7, "Number of days to keep data streams; rotate will remove streams older than # days")
-	inputLogfile := flag.String("log", "/tmp/ipcam-stream.log", "File to register logs")
+	flag.Parse()
 
-	inputCfgFile := flag.String("cfg", "", "Input configuration file (JSON)")
+	if *inputCfgFile != "" {
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Flags()").Message("reading config file").Metadata(log.Field{"path": *inputCfgFile}).Build()
 
-	flag.Parse()
+		if err := LoadConfig(flag.CommandLine, req, *inputCfgFile); err != nil {
+			logCh <- log.NewMessage().Level(log.LLFatal).Sub("Flags()").Message("unable to read config file").Metadata(log.Field{"path": *inputCfgFile, "error": err.Error()}).Build()
+		}
+	}
 
 	// handle logfile config
-	if *inputLogfile != "" {
-		s.logfileHandler(*inputLogfile)
+	if req.Logfile != "" {
+		s.logfileHandler(req.Logfile)
 	}
 
-	logCh <- log.NewMessage().Sub("Flags()").Message("parsed flags from CLI").Metadata(log.Field{
-		"len":    *inputLen,
-		"vurl":   *inputVideoURL,
-		"aurl":   *inputAudioURL,
-		"tmp":    *inputTmpDir,
-		"out":    *inputOutDir,
-		"ext":    *inputExtension,
-		"vrate":  *inputVideoRate,
-		"rotate": *inputRotate,
-		"log":    *inputLogfile,
-		"cfg":    *inputCfgFile,
-	}).Build()
+	// the broker and discovery flags only change the MQTT settings when set
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mqtt":
+			if req.MQTT == nil {
+				req.MQTT = &MQTTConfig{}
+			}
+			req.MQTT.Broker = *inputMQTT
+		case "hass":
+			if req.MQTT == nil {
+				logCh <- log.NewMessage().Level(log.LLFatal).Sub("Flags()").Message("Home Assistant discovery requires a MQTT broker").Build()
+			}
+			req.MQTT.Discovery = *inputHass
+		}
+	})
 
-	if *inputCfgFile != "" {
-		cfg := &StreamRequest{}
+	logCh <- log.NewMessage().Sub("Flags()").Message("parsed flags and config").Metadata(log.Field{"cfg": *inputCfgFile}).Build()
 
-		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Flags()").Message("reading config file").Metadata(log.Field{"path": *inputCfgFile}).Build()
+	return req
+}
 
-		data, err := os.ReadFile(*inputCfgFile)
-		if err != nil {
+// RetentionFlags binds the output and retention flags shared by the recorder
+// and the retention command to req
+func RetentionFlags(fs *flag.FlagSet, req *StreamRequest) {
+	fs.StringVar(&req.OutDir, "out", "~/", "Output directory to place files")
+	fs.IntVar(&req.Rotate, "rotate", 7, "Number of days to keep data streams; rotate will remove streams older than # days")
+	fs.StringVar(&req.Timezone, "tz", "Local", "Time zone for folder and file names, and for rotation (e.g. UTC, Europe/Lisbon)")
+	fs.StringVar(&req.Layout, "layout", DefaultLayout, "Output path template, relative to the output directory; tokens: {camera} {date} {datetime} {YYYY} {MM} {DD} {hh} {mm} {ss}")
+	fs.StringVar(&req.Quota, "quota", "", "Storage quota for all recordings in the output directory, in bytes (e.g. 500G) or percent of the filesystem (e.g. 80%)")
+	fs.StringVar(&req.CamQuota, "cquota", "", "Storage quota for this camera's recordings, in bytes (e.g. 100G) or percent of the filesystem (e.g. 20%)")
+	fs.Var(&tiersFlag{tiers: &req.Tiers}, "tiers", "Retention tiers re-encoding older recordings, as days:profile pairs (e.g. 3:archive,14:archive-low)")
+}
 
-			logCh <- log.NewMessage().Level(log.LLFatal).Sub("Flags()").Message("unable to read file").Metadata(log.Field{"path": *inputCfgFile, "error": err.Error()}).Build()
-		}
+// LoadConfig reads the JSON config file at path into req, whose fields are bound
+// to the flags in fs, once fs is parsed. The settings in the file replace the
+// flag defaults, and the flags set on the command line replace the file's
+func LoadConfig(fs *flag.FlagSet, req *StreamRequest, path string) error {
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
 
-		if err := json.Unmarshal(data, cfg); err != nil {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
 
-			logCh <- log.NewMessage().Level(log.LLFatal).Sub("Flags()").Message("unable to parse JSON data").Metadata(log.Field{"path": *inputCfgFile, "error": err.Error()}).Build()
+	if err := json.Unmarshal(data, req); err != nil {
+		return err
+	}
 
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return err
 		}
+	}
 
-		if cfg.Logfile != "" {
-			s.logfileHandler(cfg.Logfile)
-		}
+	return nil
+}
+
+// tiersFlag parses the -tiers flag into a request's retention tiers
+type tiersFlag struct {
+	tiers *[]*RetentionTier
+	value string
+}
+
+func (f *tiersFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *tiersFlag) Set(value string) error {
+	tiers, err := ParseTiers(value)
+	if err != nil {
+		return err
+	}
+
+	*f.tiers = tiers
+	f.value = value
+
+	return nil
+}
 
-		logCh <- log.NewMessage().Sub("Flags()").Message("read config from file successfully").Metadata(log.Field{
-			"len":    cfg.TimeLen,
-			"vurl":   cfg.VideoURL,
-			"aurl":   cfg.AudioURL,
-			"tmp":    cfg.TmpDir,
-			"out":    cfg.OutDir,
-			"ext":    cfg.OutExt,
-			"vrate":  cfg.VideoRate,
-			"rotate": cfg.Rotate,
-			"log":    cfg.Logfile,
-			"cfg":    *inputCfgFile,
-		}).Build()
-
-		return cfg
+// logFields lists the request's settings for the logs. Credentials are left
+// out: auth, webhooks and MQTT are reduced to whether (or how many) are set
+func (r *StreamRequest) logFields() log.Field {
+	fields := log.Field{}
 
+	if data, err := json.Marshal(r); err == nil {
+		json.Unmarshal(data, &fields)
 	}
 
-	return &StreamRequest{
-		TimeLen:   *inputLen,
-		VideoURL:  *inputVideoURL,
-		AudioURL:  *inputAudioURL,
-		TmpDir:    *inputTmpDir,
-		OutDir:    *inputOutDir,
-		OutExt:    *inputExtension,
-		VideoRate: *inputVideoRate,
-		Rotate:    *inputRotate,
+	for key, raw := range map[string]string{"videoURL": r.VideoURL, "audioURL": r.AudioURL} {
+		if raw != "" {
+			fields[key] = redactURL(raw)
+		}
 	}
+
+	fields["auth"] = r.Auth.Enabled()
+	fields["webhooks"] = len(r.Webhooks)
+	fields["mqtt"] = r.MQTT != nil
+	fields["hass"] = r.MQTT != nil && r.MQTT.Discovery
+
+	return fields
 }
 
 func (s *StreamService) logfileHandler(path string) {
@@ -0,0 +1,174 @@
+package ipcam
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+const guardInterval = 30 * time.Second
+
+// usageOf and deviceOf read the filesystems' usage and IDs; variables so that
+// tests can fake them
+var (
+	usageOf  = diskUsage
+	deviceOf = device
+)
+
+// diskGuard watches the free space in the cache and output directories. When it
+// drops below the minimum, the oldest recordings are removed; if that doesn't
+// free enough space the guard flags the service as degraded, so that merges use
+// the low-disk profile instead of failing. Recordings are only removed for the
+// paths on the same filesystem as the output directory, as removing them frees
+// no space elsewhere.
+//
+// The disk.low and disk.critical events are published when a path becomes low
+// on space, or critical (still low after the emergency retention), rather than
+// on every check
+type diskGuard struct {
+	paths    []string
+	out      string
+	minFree  *Quota
+	dir      func() *dir
+	events   *EventBus
+	degraded int32
+
+	// low and critical hold the paths' states, only used by check
+	low      map[string]bool
+	critical map[string]bool
+}
+
+func (g *diskGuard) run() {
+	defer logPanics("diskGuard.run()")
+
+	for {
+		g.check()
+		time.Sleep(guardInterval)
+	}
+}
+
+func (g *diskGuard) Degraded() bool {
+	return g != nil && atomic.LoadInt32(&g.degraded) == 1
+}
+
+func (g *diskGuard) check() {
+	if g.low == nil {
+		g.low = map[string]bool{}
+		g.critical = map[string]bool{}
+	}
+
+	low := false
+
+	for _, path := range g.paths {
+		need, err := g.need(path)
+		if err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("diskGuard.check()").Message("unable to read disk usage").Metadata(log.Field{"path": path, "error": err.Error()}).Build()
+			continue
+		}
+
+		if need <= 0 {
+			if setState(g.low, path, false) {
+				logCh <- log.NewMessage().Sub("diskGuard.check()").Message("disk space recovered").Metadata(log.Field{"path": path, "minFree": g.minFree.String()}).Build()
+			}
+			setState(g.critical, path, false)
+			continue
+		}
+
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("diskGuard.check()").Message("low disk space -- starting emergency retention").Metadata(log.Field{
+			"path":    path,
+			"minFree": g.minFree.String(),
+			"need":    need,
+		}).Build()
+
+		if setState(g.low, path, true) {
+			g.events.publish(&Event{Type: EventDiskLow, Path: path, Bytes: need})
+		}
+
+		if same, err := g.onOutput(path); err != nil || !same {
+			low = true
+
+			logCh <- log.NewMessage().Level(log.LLError).Sub("diskGuard.check()").Message("critical: disk space low outside the output filesystem -- no recordings to remove").Metadata(log.Field{
+				"path":    path,
+				"minFree": g.minFree.String(),
+				"need":    need,
+			}).Build()
+
+			if setState(g.critical, path, true) {
+				g.events.publish(&Event{Type: EventDiskCritical, Path: path, Bytes: need, Error: "disk space low outside the output filesystem"})
+			}
+			continue
+		}
+
+		g.dir().free(need, path)
+
+		if need, err = g.need(path); err == nil && need > 0 {
+			low = true
+
+			logCh <- log.NewMessage().Level(log.LLError).Sub("diskGuard.check()").Message("critical: disk space still low after emergency retention").Metadata(log.Field{
+				"path":    path,
+				"minFree": g.minFree.String(),
+				"need":    need,
+			}).Build()
+
+			if setState(g.critical, path, true) {
+				g.events.publish(&Event{Type: EventDiskCritical, Path: path, Bytes: need, Error: "disk space still low after emergency retention"})
+			}
+			continue
+		}
+
+		setState(g.critical, path, false)
+	}
+
+	if low && atomic.CompareAndSwapInt32(&g.degraded, 0, 1) {
+		logCh <- log.NewMessage().Level(log.LLError).Sub("diskGuard.check()").Message("entering degraded mode -- merging with the low-disk profile").Metadata(log.Field{"profile": LowDiskProfile.Name}).Build()
+	}
+
+	if !low && atomic.CompareAndSwapInt32(&g.degraded, 1, 0) {
+		logCh <- log.NewMessage().Sub("diskGuard.check()").Message("disk space recovered -- leaving degraded mode").Build()
+	}
+}
+
+// onOutput reports whether path is on the output directory's filesystem
+func (g *diskGuard) onOutput(path string) (bool, error) {
+	if path == g.out {
+		return true, nil
+	}
+
+	dev, err := deviceOf(path)
+	if err != nil {
+		return false, err
+	}
+
+	out, err := deviceOf(g.out)
+	if err != nil {
+		return false, err
+	}
+
+	return dev == out, nil
+}
+
+// need returns how many bytes must be freed in path's filesystem to reach the minimum
+func (g *diskGuard) need(path string) (int64, error) {
+	usage, err := usageOf(path)
+	if err != nil {
+		return 0, err
+	}
+
+	min, err := g.minFree.Limit(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return min - int64(usage.Free), nil
+}
+
+// setState sets path's state in states, reporting whether it changed
+func setState(states map[string]bool, path string, on bool) bool {
+	if states[path] == on {
+		return false
+	}
+
+	states[path] = on
+	return true
+}
@@ -0,0 +1,197 @@
+package ipcam
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDisk makes the output directory root look like a filesystem of capacity
+// bytes, whose free space grows as its files are removed. Other paths are on
+// another filesystem, with free bytes left
+func fakeDisk(t *testing.T, root string, capacity, free int64) {
+	t.Helper()
+
+	usage, dev := usageOf, deviceOf
+	t.Cleanup(func() {
+		usageOf, deviceOf = usage, dev
+	})
+
+	usageOf = func(path string) (*DiskUsage, error) {
+		if !strings.HasPrefix(path, root) {
+			return &DiskUsage{Total: uint64(capacity), Free: uint64(free)}, nil
+		}
+
+		var used int64
+		err := filepath.WalkDir(root, func(_ string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			used += info.Size()
+			return nil
+		})
+
+		return &DiskUsage{Total: uint64(capacity), Free: uint64(capacity - used), Used: uint64(used)}, err
+	}
+
+	deviceOf = func(path string) (uint64, error) {
+		if strings.HasPrefix(path, root) {
+			return 1, nil
+		}
+		return 2, nil
+	}
+}
+
+func drain(events <-chan *Event) []string {
+	var got []string
+	for len(events) > 0 {
+		e := <-events
+		got = append(got, string(e.Type)+":"+e.Path)
+	}
+	return got
+}
+
+func TestDiskGuard(t *testing.T) {
+	d := testDir(t, time.UTC)
+	d.events = NewEventBus()
+
+	start := time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC)
+
+	var paths []string
+	for n := 0; n < 3; n++ {
+		paths = append(paths, d.record(t, "front", start.Add(time.Duration(n)*time.Hour), time.Time{}, 100))
+	}
+
+	fakeDisk(t, d.root, 1000, 1000)
+
+	events, unsubscribe := d.events.Subscribe("test")
+	defer unsubscribe()
+
+	g := &diskGuard{
+		paths:   []string{d.root},
+		out:     d.root,
+		minFree: &Quota{Bytes: 750},
+		dir:     func() *dir { return d },
+		events:  d.events,
+	}
+
+	// 700 bytes free: removing the oldest recording is enough
+	g.check()
+
+	if got := drain(events); strings.Join(got, " ") != "disk.low:"+d.root {
+		t.Errorf("got events %v, want one disk.low", got)
+	}
+	if exists(paths[0]) || !exists(paths[1]) || g.Degraded() {
+		t.Errorf("want only the oldest recording removed, not degraded: %v %v %v", exists(paths[0]), exists(paths[1]), g.Degraded())
+	}
+
+	// back above the minimum: nothing to publish
+	g.check()
+
+	if got := drain(events); len(got) != 0 {
+		t.Errorf("got events %v, want none", got)
+	}
+
+	// more than the whole archive is needed: low, then critical, only once
+	g.minFree = &Quota{Bytes: 2000}
+
+	for n := 0; n < 3; n++ {
+		g.check()
+	}
+
+	want := "disk.low:" + d.root + " disk.critical:" + d.root
+	if got := drain(events); strings.Join(got, " ") != want {
+		t.Errorf("got events %v, want %s", got, want)
+	}
+	if exists(paths[1]) || exists(paths[2]) || !g.Degraded() {
+		t.Errorf("want all recordings removed, and degraded: %v %v %v", exists(paths[1]), exists(paths[2]), g.Degraded())
+	}
+
+	// recovered
+	g.minFree = &Quota{Bytes: 1}
+	g.check()
+
+	if got := drain(events); len(got) != 0 || g.Degraded() {
+		t.Errorf("got events %v and degraded %v, want none and not degraded", got, g.Degraded())
+	}
+}
+
+func TestDiskGuardOtherFilesystem(t *testing.T) {
+	d := testDir(t, time.UTC)
+	d.events = NewEventBus()
+
+	path := d.record(t, "front", time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC), time.Time{}, 100)
+
+	// the cache directory is on another, full, filesystem
+	fakeDisk(t, d.root, 1000, 10)
+
+	events, unsubscribe := d.events.Subscribe("test")
+	defer unsubscribe()
+
+	g := &diskGuard{
+		paths:   []string{"/cache", d.root},
+		out:     d.root,
+		minFree: &Quota{Bytes: 100},
+		dir:     func() *dir { return d },
+		events:  d.events,
+	}
+
+	g.check()
+	g.check()
+
+	if got := drain(events); strings.Join(got, " ") != "disk.low:/cache disk.critical:/cache" {
+		t.Errorf("got events %v, want disk.low and disk.critical for the cache", got)
+	}
+	if !exists(path) || !g.Degraded() {
+		t.Errorf("want the recording kept, and degraded: %v %v", exists(path), g.Degraded())
+	}
+}
+
+func TestFree(t *testing.T) {
+	d := testDir(t, time.UTC)
+
+	start := time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC)
+
+	var paths []string
+	for n := 0; n < 4; n++ {
+		paths = append(paths, d.record(t, "front", start.Add(time.Duration(n)*time.Hour), time.Time{}, 100))
+	}
+
+	protections, err := OpenProtections(d.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protections.Add(&Protection{Path: paths[0]}); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeDisk(t, d.root, 1000, 1000)
+
+	// the oldest recording is protected, so the next two are removed
+	if freed := d.free(150, d.root); freed != 200 {
+		t.Errorf("freed %d bytes, want 200", freed)
+	}
+
+	if !exists(paths[0]) || exists(paths[1]) || exists(paths[2]) || !exists(paths[3]) {
+		t.Errorf("unexpected files left: %v %v %v %v", exists(paths[0]), exists(paths[1]), exists(paths[2]), exists(paths[3]))
+	}
+
+	// removals which don't free any space (e.g. files held open) stop early
+	usageOf = func(string) (*DiskUsage, error) {
+		return &DiskUsage{Total: 1000, Free: 10}, nil
+	}
+
+	d.record(t, "front", start.Add(5*time.Hour), time.Time{}, 100)
+
+	if freed := d.free(1000, d.root); freed != 100 {
+		t.Errorf("freed %d bytes, want 100 before stopping", freed)
+	}
+}
@@ -0,0 +1,263 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/zalgonoise/zlog/log"
+)
+
+const (
+	defaultDiscoveryPrefix = "homeassistant"
+
+	hassOn    = "ON"
+	hassOff   = "OFF"
+	hassPress = "PRESS"
+
+	// recordingTemplate maps the state's recording flag to ON / OFF
+	recordingTemplate = "{{ 'ON' if value_json.recording else 'OFF' }}"
+)
+
+// hassDevice groups the camera's entities into a single device in Home Assistant
+type hassDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// hassEntity is a Home Assistant MQTT discovery payload; only the fields
+// relevant to the entity's component are set
+type hassEntity struct {
+	component string
+	object    string
+
+	Name              string      `json:"name"`
+	UniqueID          string      `json:"unique_id"`
+	Device            *hassDevice `json:"device"`
+	AvailabilityTopic string      `json:"availability_topic"`
+	Icon              string      `json:"icon,omitempty"`
+	DeviceClass       string      `json:"device_class,omitempty"`
+	EntityCategory    string      `json:"entity_category,omitempty"`
+
+	StateTopic        string `json:"state_topic,omitempty"`
+	ValueTemplate     string `json:"value_template,omitempty"`
+	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
+	StateClass        string `json:"state_class,omitempty"`
+
+	CommandTopic string `json:"command_topic,omitempty"`
+	PayloadOn    string `json:"payload_on,omitempty"`
+	PayloadOff   string `json:"payload_off,omitempty"`
+	StateOn      string `json:"state_on,omitempty"`
+	StateOff     string `json:"state_off,omitempty"`
+	PayloadPress string `json:"payload_press,omitempty"`
+
+	Topic string `json:"topic,omitempty"`
+}
+
+// hassID turns name into a Home Assistant node or object ID, which only allows
+// letters, digits, dashes and underscores
+func hassID(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, sanitize(name))
+}
+
+// entities lists the camera's Home Assistant entities: a recording binary
+// sensor and switch, bitrate and disk usage sensors, and buttons to cut the
+// segment and (with the live view) to take a snapshot
+func (p *mqttPublisher) entities() []*hassEntity {
+	camera := p.svc.request.Camera
+	node := "ipcam_" + hassID(camera)
+
+	device := &hassDevice{
+		Identifiers:  []string{node},
+		Name:         camera,
+		Manufacturer: "ipcam-stream",
+		Model:        "IP camera recorder",
+	}
+
+	entities := []*hassEntity{
+		{
+			component:     "binary_sensor",
+			object:        "recording",
+			Name:          camera + " recording",
+			DeviceClass:   "running",
+			StateTopic:    p.topic("state"),
+			ValueTemplate: recordingTemplate,
+		},
+		{
+			component:         "sensor",
+			object:            "bitrate",
+			Name:              camera + " bitrate",
+			DeviceClass:       "data_rate",
+			StateTopic:        p.topic("sensors"),
+			ValueTemplate:     "{{ value_json.bitrate }}",
+			UnitOfMeasurement: "kbit/s",
+			StateClass:        "measurement",
+		},
+		{
+			component:         "sensor",
+			object:            "disk_usage",
+			Name:              camera + " disk usage",
+			Icon:              "mdi:harddisk",
+			EntityCategory:    "diagnostic",
+			StateTopic:        p.topic("sensors"),
+			ValueTemplate:     "{{ value_json.diskUsage }}",
+			UnitOfMeasurement: "%",
+			StateClass:        "measurement",
+		},
+		{
+			component:     "switch",
+			object:        "recording_switch",
+			Name:          camera + " record",
+			Icon:          "mdi:record-rec",
+			StateTopic:    p.topic("state"),
+			ValueTemplate: recordingTemplate,
+			CommandTopic:  p.base + "/recording/set",
+			PayloadOn:     hassOn,
+			PayloadOff:    hassOff,
+			StateOn:       hassOn,
+			StateOff:      hassOff,
+		},
+		{
+			component:    "button",
+			object:       "cut",
+			Name:         camera + " cut segment",
+			Icon:         "mdi:content-cut",
+			CommandTopic: p.base + "/cut/press",
+			PayloadPress: hassPress,
+		},
+	}
+
+	// the snapshot is taken from the live view's last frame
+	if p.svc.request.HTTPAddr != "" {
+		entities = append(entities,
+			&hassEntity{
+				component:    "button",
+				object:       "snapshot_button",
+				Name:         camera + " take snapshot",
+				Icon:         "mdi:camera",
+				CommandTopic: p.base + "/snapshot/press",
+				PayloadPress: hassPress,
+			},
+			&hassEntity{
+				component: "camera",
+				object:    "snapshot",
+				Name:      camera + " snapshot",
+				Topic:     p.base + "/snapshot",
+			},
+		)
+	}
+
+	for _, e := range entities {
+		e.UniqueID = node + "_" + e.object
+		e.Device = device
+		e.AvailabilityTopic = p.topic("availability")
+	}
+
+	return entities
+}
+
+// discover announces the camera's entities to Home Assistant and subscribes to
+// their command topics, as well as to Home Assistant's status so that the
+// entities are announced again when it restarts
+func (p *mqttPublisher) discover() {
+	prefix := p.cfg.DiscoveryPrefix
+	if prefix == "" {
+		prefix = defaultDiscoveryPrefix
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	node := "ipcam_" + hassID(p.svc.request.Camera)
+
+	announce := func() {
+		for _, e := range p.entities() {
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+
+			p.publish(prefix+"/"+e.component+"/"+node+"/"+e.object+"/config", true, data)
+		}
+	}
+
+	announce()
+
+	p.subscribe(prefix+"/status", func(payload string) {
+		if payload == mqttOnline {
+			announce()
+			p.publishState()
+			p.publishSensors()
+		}
+	})
+
+	p.subscribe(p.base+"/recording/set", func(payload string) {
+		var err error
+
+		switch payload {
+		case hassOn:
+			err = p.svc.StartRecording()
+		case hassOff:
+			err = p.svc.StopRecording()
+		default:
+			return
+		}
+
+		if err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("mqtt()").Message("unable to switch the recorder").Metadata(log.Field{"command": payload, "error": err.Error()}).Build()
+		}
+
+		// publish the state even if the switch failed, for Home Assistant to
+		// revert its optimistic state
+		p.publishState()
+	})
+
+	p.subscribe(p.base+"/cut/press", func(string) {
+		if err := p.svc.CutSegment(); err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("mqtt()").Message("unable to cut the segment").Metadata(log.Field{"error": err.Error()}).Build()
+		}
+	})
+
+	if p.svc.request.HTTPAddr == "" {
+		return
+	}
+
+	p.subscribe(p.base+"/snapshot/press", func(string) {
+		frame := p.svc.live.Last()
+		if frame == nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("mqtt()").Message("no live frame for the snapshot").Build()
+			return
+		}
+
+		// not retained, to keep camera images off the broker
+		p.publish(p.base+"/snapshot", false, frame)
+	})
+}
+
+// subscribe calls fn with the payload of each message on topic
+func (p *mqttPublisher) subscribe(topic string, fn func(payload string)) {
+	token := p.client.Subscribe(topic, p.cfg.QoS, func(_ mqtt.Client, msg mqtt.Message) {
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("mqtt()").Message("received MQTT command").Metadata(log.Field{"topic": msg.Topic(), "payload": string(msg.Payload())}).Build()
+
+		fn(string(msg.Payload()))
+	})
+
+	go func() {
+		if !token.WaitTimeout(mqttTimeout) {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("mqtt()").Message("timed out subscribing to MQTT topic").Metadata(log.Field{"topic": topic}).Build()
+			return
+		}
+
+		if err := token.Error(); err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("mqtt()").Message("failed to subscribe to MQTT topic").Metadata(log.Field{"topic": topic, "error": err.Error()}).Build()
+		}
+	}()
+}
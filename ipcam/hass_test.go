@@ -0,0 +1,171 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHassID(t *testing.T) {
+	for name, want := range map[string]string{
+		"cam":        "cam",
+		"Front Door": "front_door",
+		"a/b":        "a_b",
+		"Cam-2.east": "cam-2_east",
+	} {
+		if got := hassID(name); got != want {
+			t.Errorf("hassID(%q): got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHassEntities(t *testing.T) {
+	s := testService("Front Door")
+	p := newMQTTPublisher(&MQTTConfig{Broker: "tcp://localhost:1883"}, s)
+
+	entities := p.entities()
+	if len(entities) != 5 {
+		t.Fatalf("got %d entities without the HTTP API, want 5", len(entities))
+	}
+
+	s.request.HTTPAddr = "localhost:8080"
+	entities = p.entities()
+
+	want := map[string]map[string]interface{}{
+		"binary_sensor/recording": {
+			"name":           "Front Door recording",
+			"device_class":   "running",
+			"state_topic":    "ipcam/Front_Door/state",
+			"value_template": recordingTemplate,
+		},
+		"sensor/bitrate": {
+			"state_topic":         "ipcam/Front_Door/sensors",
+			"value_template":      "{{ value_json.bitrate }}",
+			"unit_of_measurement": "kbit/s",
+			"state_class":         "measurement",
+		},
+		"sensor/disk_usage": {
+			"entity_category":     "diagnostic",
+			"unit_of_measurement": "%",
+		},
+		"switch/recording_switch": {
+			"command_topic": "ipcam/Front_Door/recording/set",
+			"payload_on":    hassOn,
+			"payload_off":   hassOff,
+			"state_on":      hassOn,
+			"state_off":     hassOff,
+		},
+		"button/cut": {
+			"command_topic": "ipcam/Front_Door/cut/press",
+			"payload_press": hassPress,
+		},
+		"button/snapshot_button": {
+			"command_topic": "ipcam/Front_Door/snapshot/press",
+		},
+		"camera/snapshot": {
+			"topic": "ipcam/Front_Door/snapshot",
+		},
+	}
+
+	if len(entities) != len(want) {
+		t.Fatalf("got %d entities, want %d", len(entities), len(want))
+	}
+
+	ids := map[string]bool{}
+
+	for _, e := range entities {
+		key := e.component + "/" + e.object
+
+		fields, ok := want[key]
+		if !ok {
+			t.Errorf("unexpected entity %s", key)
+			continue
+		}
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload := map[string]interface{}{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			t.Fatal(err)
+		}
+
+		for field, value := range fields {
+			if payload[field] != value {
+				t.Errorf("%s: %s: got %v, want %v", key, field, payload[field], value)
+			}
+		}
+
+		// common to all entities
+		id, _ := payload["unique_id"].(string)
+		if id != "ipcam_front_door_"+e.object || ids[id] {
+			t.Errorf("%s: unexpected or repeated unique_id %q", key, id)
+		}
+		ids[id] = true
+
+		if payload["availability_topic"] != "ipcam/Front_Door/availability" {
+			t.Errorf("%s: unexpected availability_topic %v", key, payload["availability_topic"])
+		}
+
+		device, _ := payload["device"].(map[string]interface{})
+		if device == nil || device["name"] != "Front Door" {
+			t.Errorf("%s: unexpected device %v", key, payload["device"])
+		}
+
+		// fields of other components are left out
+		if e.component != "switch" {
+			if _, ok := payload["payload_on"]; ok {
+				t.Errorf("%s: has a payload_on field", key)
+			}
+		}
+	}
+}
+
+func TestHassDiscovery(t *testing.T) {
+	broker := newFakeBroker(t)
+
+	s := testService("Front Door")
+	s.request.HTTPAddr = "localhost:8080"
+	s.live = NewBroadcaster()
+
+	p := newMQTTPublisher(&MQTTConfig{Broker: broker.url(), QoS: 1, Discovery: true, DiscoveryPrefix: "ha/"}, s)
+	p.start(s.Events)
+	defer p.Close()
+
+	config := broker.next("ha/switch/ipcam_front_door/recording_switch/config")
+	if !config.Retain {
+		t.Error("discovery config isn't retained")
+	}
+
+	broker.subscribed("ipcam/Front_Door/recording/set")
+	broker.send("ipcam/Front_Door/recording/set", hassOff)
+
+	status := &Status{}
+	for {
+		state := broker.next("ipcam/Front_Door/state")
+		if err := json.Unmarshal(state.Payload, status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.Recording {
+			break
+		}
+	}
+
+	if s.control.status().Recording {
+		t.Error("the switch didn't stop the recorder")
+	}
+
+	broker.subscribed("ipcam/Front_Door/snapshot/press")
+
+	s.live.publish(jpeg(0x01, 0x02))
+	broker.send("ipcam/Front_Door/snapshot/press", hassPress)
+
+	snapshot := broker.next("ipcam/Front_Door/snapshot")
+	if snapshot.Retain {
+		t.Error("snapshot is retained")
+	}
+	if string(snapshot.Payload) != string(jpeg(0x01, 0x02)) {
+		t.Errorf("unexpected snapshot % X", snapshot.Payload)
+	}
+}
@@ -0,0 +1,195 @@
+package ipcam
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+	"github.com/zalgonoise/zlog/log"
+)
+
+const (
+	hlsDir      = "hls"
+	hlsPlaylist = "index.m3u8"
+	hlsPrefix   = "/live/hls/"
+
+	defaultHLSTime   = 2
+	defaultHLSWindow = 6
+)
+
+// HLSPipeline encodes the live frames into a rolling window of HLS segments,
+// with ffmpeg reading the frames from a pipe (so the camera isn't connected to
+// again). Old segments are deleted as the window moves
+type HLSPipeline struct {
+	dir    string
+	time   int
+	window int
+	live   *Broadcaster
+}
+
+func NewHLSPipeline(dir string, segmentTime, window int, live *Broadcaster) *HLSPipeline {
+	if segmentTime <= 0 {
+		segmentTime = defaultHLSTime
+	}
+	if window <= 0 {
+		window = defaultHLSWindow
+	}
+
+	return &HLSPipeline{
+		dir:    dir,
+		time:   segmentTime,
+		window: window,
+		live:   live,
+	}
+}
+
+// run keeps ffmpeg running, restarting it (with a fresh window) when it exits
+func (h *HLSPipeline) run() {
+	defer logPanics("HLSPipeline.run()")
+
+	var n int
+
+	for {
+		start := time.Now()
+
+		fields := log.Field{"path": h.dir}
+		if err := h.encode(); err != nil {
+			fields["error"] = err.Error()
+		}
+
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("HLSPipeline.run()").Message("HLS encoder exited -- restarting").Metadata(fields).Build()
+
+		// only back off (up to 16s) when ffmpeg keeps failing right away
+		if time.Since(start) > time.Minute {
+			n = 0
+		} else if n < 5 {
+			n++
+		}
+		time.Sleep(jitter(delay(n)))
+	}
+}
+
+func (h *HLSPipeline) encode() error {
+	if err := h.clear(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return err
+	}
+
+	logCh <- log.NewMessage().Sub("HLSPipeline.encode()").Message("starting HLS encoder").Metadata(log.Field{"path": h.dir, "segmentTime": h.time, "window": h.window}).Build()
+
+	cmd := ffmpeg.Input("pipe:",
+		ffmpeg.KwArgs{"f": "mjpeg"},
+		ffmpeg.KwArgs{"use_wallclock_as_timestamps": "1"},
+	).Output(filepath.Join(h.dir, hlsPlaylist), ffmpeg.KwArgs{
+		"c:v":                  "libx264",
+		"preset":               "veryfast",
+		"tune":                 "zerolatency",
+		"pix_fmt":              "yuv420p",
+		"force_key_frames":     fmt.Sprintf("expr:gte(t,n_forced*%d)", h.time),
+		"f":                    "hls",
+		"hls_time":             strconv.Itoa(h.time),
+		"hls_list_size":        strconv.Itoa(h.window),
+		"hls_flags":            "delete_segments+omit_endlist",
+		"hls_segment_filename": filepath.Join(h.dir, "segment-%06d.ts"),
+	}).OverWriteOutput().ErrorToStdOut().Compile()
+
+	// ffmpeg's stdin is a pipe closed by Wait when ffmpeg exits, so a writer
+	// waiting on frames (e.g. with the camera down) can't keep Wait from returning
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	frames, unsubscribe := h.live.Subscribe()
+	done := make(chan struct{})
+
+	go func() {
+		defer unsubscribe()
+
+		for {
+			select {
+			case <-done:
+				return
+			case frame := <-frames:
+				if _, err := stdin.Write(frame); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	defer close(done)
+
+	return cmd.Wait()
+}
+
+// clear removes the segments left behind by a previous encoder
+func (h *HLSPipeline) clear() error {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		if err := os.Remove(filepath.Join(h.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serveHLS serves the live playlist and its segments
+func (s *StreamService) serveHLS(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, hlsPrefix)
+
+	if s.hls == nil || name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		writeResponse(w, http.StatusNotFound, &apiError{Error: errNotFound.Error()})
+		return
+	}
+
+	switch filepath.Ext(name) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2t")
+	default:
+		writeResponse(w, http.StatusNotFound, &apiError{Error: errNotFound.Error()})
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.hls.dir, name))
+	if err != nil {
+		writeResponse(w, http.StatusNotFound, &apiError{Error: errNotFound.Error()})
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		writeResponse(w, http.StatusNotFound, &apiError{Error: errNotFound.Error()})
+		return
+	}
+
+	http.ServeContent(w, r, name, stat.ModTime(), f)
+}
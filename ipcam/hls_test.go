@@ -0,0 +1,113 @@
+package ipcam
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHLSClear(t *testing.T) {
+	h := NewHLSPipeline(filepath.Join(t.TempDir(), hlsDir), 0, 0, nil)
+
+	if h.time != defaultHLSTime || h.window != defaultHLSWindow {
+		t.Errorf("got segment time %d and window %d, want the defaults", h.time, h.window)
+	}
+
+	// nothing to clear before the first encoder starts
+	if err := h.clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// a previous encoder's playlist and window
+	for _, name := range []string{hlsPlaylist, "segment-000001.ts", "segment-000002.ts", "index.m3u8.tmp"} {
+		if err := os.WriteFile(filepath.Join(h.dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := h.clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("got %d files left, want none", len(entries))
+	}
+}
+
+func TestServeHLS(t *testing.T) {
+	root := t.TempDir()
+
+	h := NewHLSPipeline(filepath.Join(root, hlsDir), 0, 0, nil)
+
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{hlsPlaylist, "segment-000001.ts", ".hidden.ts", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(h.dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.ts"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := testService("front")
+	s.hls = h
+
+	for _, test := range []struct {
+		method      string
+		name        string
+		code        int
+		contentType string
+	}{
+		{http.MethodGet, hlsPlaylist, http.StatusOK, "application/vnd.apple.mpegurl"},
+		{http.MethodHead, hlsPlaylist, http.StatusOK, "application/vnd.apple.mpegurl"},
+		{http.MethodGet, "segment-000001.ts", http.StatusOK, "video/mp2t"},
+		{http.MethodPost, hlsPlaylist, http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "", http.StatusNotFound, ""},
+		{http.MethodGet, "segment-000002.ts", http.StatusNotFound, ""},
+		{http.MethodGet, ".hidden.ts", http.StatusNotFound, ""},
+		{http.MethodGet, "notes.txt", http.StatusNotFound, ""},
+		{http.MethodGet, "../secret.ts", http.StatusNotFound, ""},
+		{http.MethodGet, `..\secret.ts`, http.StatusNotFound, ""},
+		{http.MethodGet, "sub/segment-000001.ts", http.StatusNotFound, ""},
+	} {
+		r := httptest.NewRequest(test.method, "/", nil)
+		r.URL.Path = hlsPrefix + test.name
+
+		w := httptest.NewRecorder()
+		s.serveHLS(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%s %q: got status %d, want %d", test.method, test.name, w.Code, test.code)
+			continue
+		}
+
+		if test.contentType != "" && w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s %q: got content type %q, want %q", test.method, test.name, w.Header().Get("Content-Type"), test.contentType)
+		}
+	}
+
+	// without the pipeline, there's nothing to serve
+	s.hls = nil
+
+	r := httptest.NewRequest(http.MethodGet, hlsPrefix+hlsPlaylist, nil)
+	w := httptest.NewRecorder()
+	s.serveHLS(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("without HLS: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,188 @@
+package ipcam
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+// Serve starts the HTTP API (control, status and recordings) on addr, over TLS
+// if a certificate is configured. It blocks until the server fails
+func (s *StreamService) Serve(addr string) error {
+	useTLS := s.request.TLSCert != ""
+
+	logCh <- log.NewMessage().Sub("Serve()").Message("starting HTTP API").Metadata(log.Field{"addr": addr, "tls": useTLS, "auth": s.request.Auth.Enabled()}).Build()
+
+	if !s.request.Auth.Enabled() {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("Serve()").Message("HTTP API has no credentials configured -- it is open to anyone who can reach it").Metadata(log.Field{"addr": addr, "loopback": loopback(addr)}).Build()
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	var err error
+	if useTLS {
+		err = srv.ListenAndServeTLS(s.request.TLSCert, s.request.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		logCh <- log.NewMessage().Level(log.LLError).Sub("Serve()").Message("HTTP API stopped").Metadata(log.Field{"addr": addr, "error": err.Error()}).Build()
+	}
+
+	return err
+}
+
+// Handler returns the HTTP API's routes, behind authentication when credentials
+// are configured
+func (s *StreamService) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/status", s.route(http.MethodGet, func(r *http.Request) (interface{}, error) {
+		return s.Status(), nil
+	}))
+
+	mux.HandleFunc("/api/start", s.route(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		if err := s.StartRecording(); err != nil {
+			return nil, err
+		}
+		return s.Status(), nil
+	}))
+
+	mux.HandleFunc("/api/stop", s.route(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		if err := s.StopRecording(); err != nil {
+			return nil, err
+		}
+		return s.Status(), nil
+	}))
+
+	mux.HandleFunc("/api/cut", s.route(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		if err := s.CutSegment(); err != nil {
+			return nil, err
+		}
+		return s.Status(), nil
+	}))
+
+	mux.HandleFunc("/api/retention", s.route(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+
+		logCh <- log.NewMessage().Sub("Handler()").Message("retention run requested").Metadata(log.Field{"dryRun": dryRun}).Build()
+
+		report := s.Retention(dryRun)
+
+		// tier re-encodes can take hours, so they aren't part of the response
+		if !dryRun {
+			go s.Downsample()
+		}
+
+		return report, nil
+	}))
+
+	mux.HandleFunc("/api/webhooks/deliveries", s.route(http.MethodGet, func(r *http.Request) (interface{}, error) {
+		return s.hooks.Deliveries(), nil
+	}))
+
+	mux.HandleFunc("/api/recordings", s.route(http.MethodGet, func(r *http.Request) (interface{}, error) {
+		return s.Days(r.URL.Query().Get("camera")), nil
+	}))
+
+	mux.HandleFunc("/api/recordings/", s.route(http.MethodGet, func(r *http.Request) (interface{}, error) {
+		date := strings.TrimPrefix(r.URL.Path, "/api/recordings/")
+
+		segments, err := s.Segments(r.URL.Query().Get("camera"), date)
+		if err != nil {
+			return nil, &statusError{code: http.StatusBadRequest, err: err}
+		}
+		return segments, nil
+	}))
+
+	mux.HandleFunc(filesPrefix, s.serveFile)
+
+	mux.HandleFunc("/live/video.mjpeg", s.serveMJPEG)
+	mux.HandleFunc("/live/snapshot.jpg", s.serveSnapshot)
+	mux.HandleFunc(hlsPrefix, s.serveHLS)
+
+	mux.HandleFunc("/metrics", s.serveMetrics)
+
+	if s.request.Auth.Enabled() {
+		return newAuthenticator(s.request.Auth).wrap(mux)
+	}
+
+	return mux
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// statusError sets the HTTP status code of a failed API call; other errors are
+// reported as conflicts with the recorder's state
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// route wraps an API call, checking the request method and encoding its result
+// (or error) as JSON
+func (s *StreamService) route(method string, call func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeResponse(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+			return
+		}
+
+		v, err := call(r)
+		if err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("Handler()").Message("API request failed").Metadata(log.Field{"path": r.URL.Path, "error": err.Error()}).Build()
+
+			code := http.StatusConflict
+
+			var se *statusError
+			if errors.As(err, &se) {
+				code = se.code
+			}
+
+			writeResponse(w, code, &apiError{Error: err.Error()})
+			return
+		}
+
+		writeResponse(w, http.StatusOK, v)
+	}
+}
+
+// readOnly rejects requests other than GET and HEAD, returning false
+func readOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+
+	w.Header().Set("Allow", "GET, HEAD")
+	writeResponse(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+	return false
+}
+
+func writeResponse(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,285 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+const indexFile = "index.json"
+
+type Index struct {
+	mu      sync.Mutex
+	path    string
+	root    string
+	layout  *Layout
+	Entries []*IndexEntry `json:"entries"`
+}
+
+type IndexEntry struct {
+	Camera string    `json:"camera"`
+	Path   string    `json:"path"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Bytes  int64     `json:"bytes"`
+}
+
+func OpenIndex(root string, layout *Layout) (*Index, error) {
+	idx := newIndex(root, layout)
+
+	data, err := os.ReadFile(idx.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return idx, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+func RebuildIndex(root string, layout *Layout) (*Index, error) {
+	idx := newIndex(root, layout)
+
+	return idx, idx.Rebuild()
+}
+
+func newIndex(root string, layout *Layout) *Index {
+	if layout == nil {
+		layout, _ = ParseLayout(DefaultLayout, time.Local)
+	}
+
+	return &Index{
+		path:   filepath.Join(root, indexFile),
+		root:   root,
+		layout: layout,
+	}
+}
+
+func (i *Index) Add(entry *IndexEntry) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.add(entry)
+
+	return i.save()
+}
+
+func (i *Index) add(entry *IndexEntry) {
+	for n, e := range i.Entries {
+		if e.Path == entry.Path {
+			i.Entries[n] = entry
+			return
+		}
+	}
+
+	i.Entries = append(i.Entries, entry)
+
+	sort.Slice(i.Entries, func(a, b int) bool {
+		return i.Entries[a].Start.Before(i.Entries[b].Start)
+	})
+}
+
+// Resize updates the size of the entry for path, after it's been re-encoded
+func (i *Index) Resize(path string, size int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, e := range i.Entries {
+		if e.Path == path {
+			e.Bytes = size
+			return i.save()
+		}
+	}
+
+	return nil
+}
+
+// Remove drops all entries for the input path, or contained in it when the path
+// is a directory
+func (i *Index) Remove(path string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var entries []*IndexEntry
+
+	for _, e := range i.Entries {
+		if e.Path == path || strings.HasPrefix(e.Path, strings.TrimSuffix(path, "/")+"/") {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) == len(i.Entries) {
+		return nil
+	}
+
+	i.Entries = entries
+
+	return i.save()
+}
+
+// Query returns the entries for camera which overlap the time range [from, to).
+// An empty camera matches all cameras; a zero from or to leaves that end open
+func (i *Index) Query(camera string, from, to time.Time) []*IndexEntry {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var out []*IndexEntry
+
+	for _, e := range i.Entries {
+		if camera != "" && e.Camera != camera {
+			continue
+		}
+		if !to.IsZero() && !e.Start.Before(to) {
+			continue
+		}
+		if !from.IsZero() && !e.End.After(from) {
+			continue
+		}
+		out = append(out, e)
+	}
+
+	return out
+}
+
+// Rebuild replaces the index contents by scanning the output tree for
+// recordings and their metadata sidecars
+func (i *Index) Rebuild() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	logCh <- log.NewMessage().Sub("Rebuild()").Message("rebuilding recording index").Metadata(log.Field{"path": i.root}).Build()
+
+	i.Entries = nil
+
+	entries, err := scanRecordings(i.root, i.layout)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		i.add(e)
+	}
+
+	logCh <- log.NewMessage().Sub("Rebuild()").Message("recording index rebuilt").Metadata(log.Field{"path": i.root, "entries": len(i.Entries)}).Build()
+
+	return i.save()
+}
+
+func (i *Index) save() error {
+	return writeJSONAtomic(i.path, i)
+}
+
+func scanRecordings(root string, layout *Layout) ([]*IndexEntry, error) {
+	var entries []*IndexEntry
+
+	sidecars := map[string]bool{}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if path != root && reserved[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".") || filepath.Ext(path) != sidecarExt || path == filepath.Join(root, indexFile) {
+			return nil
+		}
+
+		info, err := ReadSegmentInfo(path)
+		if err != nil || info.Output == "" || info.Result != ResultMerged {
+			return nil
+		}
+
+		sidecars[strings.TrimSuffix(path, sidecarExt)] = true
+
+		entries = append(entries, info.entry(filepath.Join(filepath.Dir(path), filepath.Base(info.Output))))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// recordings without a sidecar are indexed from their file name and mod time
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if path != root && reserved[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		ext := filepath.Ext(path)
+		if strings.HasPrefix(d.Name(), ".") || ext == sidecarExt || sidecars[strings.TrimSuffix(path, ext)] {
+			return nil
+		}
+
+		start, ok := layout.Parse(root, path)
+		if !ok {
+			return nil
+		}
+
+		stat, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		entries = append(entries, &IndexEntry{
+			Camera: layout.Camera(root, path),
+			Path:   path,
+			Start:  start,
+			End:    stat.ModTime(),
+			Bytes:  stat.Size(),
+		})
+		return nil
+	})
+
+	return entries, err
+}
+
+func (s *SegmentInfo) entry(path string) *IndexEntry {
+	e := &IndexEntry{
+		Camera: s.Camera,
+		Path:   path,
+		Start:  s.Start,
+		End:    s.End,
+	}
+
+	if stat, err := os.Stat(path); err == nil {
+		e.Bytes = stat.Size()
+	}
+
+	return e
+}
+
+func (s *SplitStream) updateIndex(info *SegmentInfo) {
+	if s.index == nil || info.Result != ResultMerged {
+		return
+	}
+
+	if err := s.index.Add(info.entry(info.Output)); err != nil {
+		logCh <- log.NewMessage().Level(log.LLError).Sub("updateIndex()").Message("failed to update recording index").Metadata(log.Field{"path": info.Output, "error": err.Error()}).Build()
+	}
+}
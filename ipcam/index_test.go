@@ -0,0 +1,167 @@
+package ipcam
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIndexQuery(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Date(2022, 5, 30, h, m, 0, 0, time.UTC)
+	}
+
+	idx := newIndex(t.TempDir(), nil)
+
+	for _, e := range []*IndexEntry{
+		{Camera: "front", Path: "/out/front-10", Start: at(10, 0), End: at(11, 0)},
+		{Camera: "back", Path: "/out/back-10", Start: at(10, 0), End: at(11, 0)},
+		{Camera: "front", Path: "/out/front-09", Start: at(9, 0), End: at(10, 0)},
+		{Camera: "front", Path: "/out/front-11", Start: at(11, 0), End: at(11, 30)},
+	} {
+		if err := idx.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		camera   string
+		from, to time.Time
+		want     []string
+	}{
+		{"all", "", time.Time{}, time.Time{}, []string{"/out/front-09", "/out/front-10", "/out/back-10", "/out/front-11"}},
+		{"camera", "front", time.Time{}, time.Time{}, []string{"/out/front-09", "/out/front-10", "/out/front-11"}},
+		{"unknown camera", "side", time.Time{}, time.Time{}, nil},
+		{"overlap", "front", at(9, 30), at(10, 30), []string{"/out/front-09", "/out/front-10"}},
+		{"end is exclusive", "front", at(9, 0), at(10, 0), []string{"/out/front-09"}},
+		{"touching start", "front", at(10, 0), at(10, 1), []string{"/out/front-10"}},
+		{"open start", "front", time.Time{}, at(10, 0), []string{"/out/front-09"}},
+		{"open end", "front", at(11, 15), time.Time{}, []string{"/out/front-11"}},
+		{"after the last", "", at(12, 0), time.Time{}, nil},
+	} {
+		var got []string
+		for _, e := range idx.Query(test.camera, test.from, test.to) {
+			got = append(got, e.Path)
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIndexAddRemove(t *testing.T) {
+	root := t.TempDir()
+	idx := newIndex(root, nil)
+
+	start := time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC)
+
+	for _, e := range []*IndexEntry{
+		{Path: "/out/2022-05-30/a.mp4", Start: start, Bytes: 1},
+		{Path: "/out/2022-05-30/a.mp4", Start: start, Bytes: 2},
+		{Path: "/out/2022-05-31/b.mp4", Start: start.Add(24 * time.Hour), Bytes: 3},
+	} {
+		if err := idx.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(idx.Entries) != 2 || idx.Entries[0].Bytes != 2 {
+		t.Fatalf("Add didn't replace the entry for the same path: %v", idx.Entries)
+	}
+
+	// a directory removes the entries under it, but not those sharing its prefix
+	if err := idx.Remove("/out/2022-05-3"); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Entries) != 2 {
+		t.Fatalf("Remove matched a partial name: %v", idx.Entries)
+	}
+
+	if err := idx.Remove("/out/2022-05-30/"); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Entries) != 1 || idx.Entries[0].Path != "/out/2022-05-31/b.mp4" {
+		t.Fatalf("unexpected entries after Remove: %v", idx.Entries)
+	}
+
+	// the index is saved on each change
+	saved, err := OpenIndex(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Entries) != 1 || saved.Entries[0].Path != "/out/2022-05-31/b.mp4" {
+		t.Errorf("unexpected saved entries: %v", saved.Entries)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	root := t.TempDir()
+
+	layout, err := ParseLayout("{camera}/{date}/{datetime}", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC)
+
+	write := func(rel string) string {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// merged, with a sidecar
+	merged := write("front/2022-05-30/2022-05-30-10-00-00Z.mp4")
+	if err := writeJSON(sidecarPath(merged), &SegmentInfo{
+		Camera: "front", Output: merged, Start: start, End: start.Add(time.Hour), Result: ResultMerged,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a sidecar, read from the layout
+	bare := write("back/2022-05-30/2022-05-30-11-00-00Z.mp4")
+
+	// failed merges, the service's own files and other files are skipped
+	failed := filepath.Join(root, "front", "2022-05-30", "2022-05-30-12-00-00Z.mp4")
+	if err := writeJSON(sidecarPath(failed), &SegmentInfo{Camera: "front", Output: failed, Result: ResultFailed}); err != nil {
+		t.Fatal(err)
+	}
+	write("failed/2022-05-30-12-00-00Z/a.mp4")
+	write(exportDir + "/2022-05-30-10-00-00Z.mp4")
+	write("front/notes.txt")
+	write("front/2022-05-30/.2022-05-30-13-00-00Z.mp4")
+
+	idx, err := RebuildIndex(root, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*IndexEntry{
+		{Camera: "front", Path: merged, Start: start, End: start.Add(time.Hour), Bytes: 4},
+		{Camera: "back", Path: bare, Start: start.Add(time.Hour), Bytes: 4},
+	}
+
+	if len(idx.Entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %v", len(idx.Entries), len(want), idx.Entries)
+	}
+
+	for n, e := range idx.Entries {
+		w := want[n]
+		if e.Camera != w.Camera || e.Path != w.Path || !e.Start.Equal(w.Start) || e.Bytes != w.Bytes {
+			t.Errorf("entry %d: got %+v, want %+v", n, e, w)
+		}
+	}
+
+	if !idx.Entries[0].End.Equal(start.Add(time.Hour)) {
+		t.Errorf("sidecar end time not used: %v", idx.Entries[0].End)
+	}
+}
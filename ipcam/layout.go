@@ -0,0 +1,204 @@
+package ipcam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLayout places each recording in a dated folder, named after its start time
+const DefaultLayout = "{date}/{datetime}"
+
+// layoutTokens maps each template token to its time format and to the pattern
+// that matches it in a path
+var layoutTokens = map[string]struct {
+	format  string
+	pattern string
+}{
+	"camera":   {"", `[^/]+`},
+	"date":     {folderLayout, `\d{4}-\d{2}-\d{2}`},
+	"datetime": {fileLayout, `\d{4}-\d{2}-\d{2}-\d{2}-\d{2}-\d{2}(?:Z|[+-]\d{4})?`},
+	"YYYY":     {"2006", `\d{4}`},
+	"MM":       {"01", `\d{2}`},
+	"DD":       {"02", `\d{2}`},
+	"hh":       {"15", `\d{2}`},
+	"mm":       {"04", `\d{2}`},
+	"ss":       {"05", `\d{2}`},
+}
+
+var tokenRe = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+
+// collisionSuffix matches the numeric suffix added by commitFile when two
+// segments map to the same path
+const collisionSuffix = `(?:-\d{1,2})?`
+
+// Layout describes where recordings are placed in the output directory, from a
+// path template such as "{camera}/{YYYY}/{MM}/{DD}/{hh}-{mm}-{ss}". Paths are
+// relative to the output directory and exclude the file extension
+type Layout struct {
+	template string
+	re       *regexp.Regexp
+	loc      *time.Location
+}
+
+func ParseLayout(template string, loc *time.Location) (*Layout, error) {
+	if template == "" {
+		template = DefaultLayout
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+
+	template = filepath.ToSlash(filepath.Clean(template))
+	if strings.HasPrefix(template, "/") || strings.HasPrefix(template, "..") {
+		return nil, fmt.Errorf("layout %q must be relative to the output directory", template)
+	}
+
+	tokens := map[string]bool{}
+
+	var pattern strings.Builder
+	var last int
+
+	for _, m := range tokenRe.FindAllStringSubmatchIndex(template, -1) {
+		name := template[m[2]:m[3]]
+
+		tok, ok := layoutTokens[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown layout token {%s}", name)
+		}
+
+		tokens[name] = true
+
+		pattern.WriteString(regexp.QuoteMeta(template[last:m[0]]))
+		pattern.WriteString("(?P<" + name + ">" + tok.pattern + ")")
+		last = m[1]
+	}
+
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+
+	// the recording's date is needed by rotation
+	if !tokens["date"] && !tokens["datetime"] && !(tokens["YYYY"] && tokens["MM"] && tokens["DD"]) {
+		return nil, errors.New("layout must include the recording date ({date}, {datetime} or {YYYY}, {MM} and {DD})")
+	}
+
+	re, err := regexp.Compile("^" + pattern.String() + collisionSuffix + "$")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Layout{
+		template: template,
+		re:       re,
+		loc:      loc,
+	}, nil
+}
+
+func (l *Layout) String() string {
+	return l.template
+}
+
+// Path returns the path of a recording for camera started at t, within root
+func (l *Layout) Path(root, camera string, t time.Time, ext string) string {
+	t = t.In(l.loc)
+
+	rel := tokenRe.ReplaceAllStringFunc(l.template, func(m string) string {
+		name := strings.Trim(m, "{}")
+
+		if name == "camera" {
+			return sanitize(camera)
+		}
+		return t.Format(layoutTokens[name].format)
+	})
+
+	return filepath.Join(root, filepath.FromSlash(rel)+ext)
+}
+
+// Parse returns the start time of the recording at path (within root), or false
+// if the path doesn't match the layout
+func (l *Layout) Parse(root, path string) (time.Time, bool) {
+	values := l.match(root, path)
+	if values == nil {
+		return time.Time{}, false
+	}
+
+	if v, ok := values["datetime"]; ok {
+		t, err := ParseFileTime(v, l.loc)
+		return t, err == nil
+	}
+
+	var year, month, day int
+
+	if v, ok := values["date"]; ok {
+		t, err := time.ParseInLocation(folderLayout, v, l.loc)
+		if err != nil {
+			return time.Time{}, false
+		}
+		year, month, day = t.Year(), int(t.Month()), t.Day()
+	} else {
+		year, month, day = atoi(values["YYYY"]), atoi(values["MM"]), atoi(values["DD"])
+	}
+
+	return time.Date(year, time.Month(month), day,
+		atoi(values["hh"]), atoi(values["mm"]), atoi(values["ss"]), 0, l.loc), true
+}
+
+// Camera returns the camera name in the path of a recording, if the layout has one
+func (l *Layout) Camera(root, path string) string {
+	return l.match(root, path)["camera"]
+}
+
+func (l *Layout) match(root, path string) map[string]string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return nil
+	}
+
+	rel = filepath.ToSlash(strings.TrimSuffix(rel, filepath.Ext(rel)))
+
+	match := l.re.FindStringSubmatch(rel)
+	if match == nil {
+		return nil
+	}
+
+	values := map[string]string{}
+	for n, name := range l.re.SubexpNames() {
+		if name != "" && values[name] == "" {
+			values[name] = match[n]
+		}
+	}
+
+	return values
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func sanitize(name string) string {
+	if name == "" {
+		return "ipcam"
+	}
+
+	return strings.NewReplacer("/", "_", `\`, "_", "..", "_").Replace(name)
+}
+
+// ExpandPath replaces a leading "~" in path with the user's home directory
+func ExpandPath(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
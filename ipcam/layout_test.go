@@ -0,0 +1,96 @@
+package ipcam
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLayout(t *testing.T) {
+	for _, test := range []struct {
+		template string
+		ok       bool
+	}{
+		{"", true},
+		{"{date}/{datetime}", true},
+		{"{camera}/{YYYY}/{MM}/{DD}/{hh}-{mm}-{ss}", true},
+		{"{camera}/{date}", true},
+		{"{YYYY}/{MM}/{hh}", false},
+		{"{camera}/{hh}-{mm}", false},
+		{"{date}/{unknown}", false},
+		{"/abs/{date}", false},
+		{"../{date}", false},
+	} {
+		_, err := ParseLayout(test.template, time.UTC)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseLayout(%q): got error %v, want ok = %v", test.template, err, test.ok)
+		}
+	}
+}
+
+func TestLayoutPath(t *testing.T) {
+	start := time.Date(2022, 5, 30, 14, 5, 9, 0, time.UTC)
+
+	for _, test := range []struct {
+		template string
+		camera   string
+		want     string
+	}{
+		{"{date}/{datetime}", "front", "2022-05-30/2022-05-30-14-05-09Z.mp4"},
+		{"{camera}/{YYYY}/{MM}/{DD}/{hh}-{mm}-{ss}", "front", "front/2022/05/30/14-05-09.mp4"},
+		{"{camera}/{date}", "a/b", "a_b/2022-05-30.mp4"},
+	} {
+		l, err := ParseLayout(test.template, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := l.Path("/out", test.camera, start, ".mp4"); got != filepath.Join("/out", test.want) {
+			t.Errorf("%s: got %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestLayoutParse(t *testing.T) {
+	for _, test := range []struct {
+		template string
+		path     string
+		ok       bool
+		want     time.Time
+		camera   string
+	}{
+		{"{date}/{datetime}", "2022-05-30/2022-05-30-14-05-09Z.mp4", true, time.Date(2022, 5, 30, 14, 5, 9, 0, time.UTC), ""},
+		{"{date}/{datetime}", "2022-05-30/2022-05-30-14-05-09.mp4", true, time.Date(2022, 5, 30, 14, 5, 9, 0, time.UTC), ""},
+		{"{date}/{datetime}", "2022-05-30/2022-05-30-14-05-09+0100.json", true, time.Date(2022, 5, 30, 13, 5, 9, 0, time.UTC), ""},
+		// the suffix added by commitFile when two segments map to the same path
+		{"{date}/{datetime}", "2022-05-30/2022-05-30-14-05-09Z-1.mp4", true, time.Date(2022, 5, 30, 14, 5, 9, 0, time.UTC), ""},
+		{"{camera}/{date}", "front/2022-05-30-12.mp4", true, time.Date(2022, 5, 30, 0, 0, 0, 0, time.UTC), "front"},
+		{"{camera}/{YYYY}/{MM}/{DD}/{hh}-{mm}-{ss}", "front/2022/05/30/14-05-09.mp4", true, time.Date(2022, 5, 30, 14, 5, 9, 0, time.UTC), "front"},
+		{"{date}/{datetime}", "2022-05-30/notes.txt", false, time.Time{}, ""},
+		{"{date}/{datetime}", "2022-05-30/2022-05-30-14-05-09Z-123.mp4", false, time.Time{}, ""},
+		{"{date}/{datetime}", "export/2022-05-30-14-05-09Z.mp4", false, time.Time{}, ""},
+	} {
+		l, err := ParseLayout(test.template, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join("/out", filepath.FromSlash(test.path))
+
+		got, ok := l.Parse("/out", path)
+		if ok != test.ok {
+			t.Errorf("%s: Parse(%q): got ok = %v, want %v", test.template, test.path, ok, test.ok)
+			continue
+		}
+
+		if !got.Equal(test.want) {
+			t.Errorf("%s: Parse(%q): got %v, want %v", test.template, test.path, got, test.want)
+		}
+
+		if ok {
+			if camera := l.Camera("/out", path); camera != test.camera {
+				t.Errorf("%s: Camera(%q): got %q, want %q", test.template, test.path, camera, test.camera)
+			}
+		}
+	}
+}
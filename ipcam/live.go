@@ -0,0 +1,265 @@
+package ipcam
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+const (
+	// maxFrameSize discards a partial frame which never ends (e.g. a corrupted stream)
+	maxFrameSize = 8 << 20
+
+	mjpegBoundary = "ipcamframe"
+)
+
+var eoi = []byte{0xFF, 0xD9}
+
+// Broadcaster re-publishes the JPEG frames received from the camera to any number
+// of live viewers, so that they don't open more connections to the camera
+type Broadcaster struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	last    []byte
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		clients: map[chan []byte]struct{}{},
+	}
+}
+
+// Subscribe returns a channel receiving each new frame, starting with the latest
+// one, and a function to unsubscribe. Slow viewers skip frames
+func (b *Broadcaster) Subscribe() (<-chan []byte, func()) {
+	ch := make(chan []byte, 2)
+
+	b.mu.Lock()
+	b.clients[ch] = struct{}{}
+	if b.last != nil {
+		ch <- b.last
+	}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.clients, ch)
+		b.mu.Unlock()
+	}
+}
+
+// Viewers returns the number of subscribed viewers
+func (b *Broadcaster) Viewers() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.clients)
+}
+
+// Last returns the latest frame, if any
+func (b *Broadcaster) Last() []byte {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.last
+}
+
+func (b *Broadcaster) publish(frame []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.last = frame
+
+	for ch := range b.clients {
+		select {
+		case ch <- frame:
+		default:
+		}
+	}
+}
+
+// writer returns a writer splitting a MJPEG stream into frames. Each connection
+// to the camera needs a new one
+func (b *Broadcaster) writer() *frameSplitter {
+	return &frameSplitter{b: b}
+}
+
+// frameSplitter extracts the JPEG images (from start-of-image to end-of-image
+// markers) from a MJPEG stream, whichever its multipart framing. Markers are
+// matched in pairs, as an embedded image (e.g. an EXIF thumbnail) has its own.
+// Its writes never fail, so that live viewing can't interrupt a recording
+type frameSplitter struct {
+	b     *Broadcaster
+	buf   []byte
+	in    bool
+	depth int
+	pos   int
+}
+
+func (f *frameSplitter) Write(p []byte) (int, error) {
+	f.buf = append(f.buf, p...)
+
+	for {
+		if !f.in {
+			idx := bytes.Index(f.buf, soi)
+			if idx < 0 {
+				// keep the last byte, in case it starts a marker
+				if len(f.buf) > 0 {
+					f.buf = append(f.buf[:0], f.buf[len(f.buf)-1])
+				}
+				break
+			}
+
+			f.buf = append(f.buf[:0], f.buf[idx:]...)
+			f.in = true
+			f.depth = 1
+			f.pos = len(soi)
+		}
+
+		size := f.scan()
+		if size < 0 {
+			if len(f.buf) > maxFrameSize {
+				f.buf = f.buf[:0]
+				f.in = false
+			}
+			break
+		}
+
+		frame := make([]byte, size)
+		copy(frame, f.buf)
+
+		f.b.publish(frame)
+
+		f.buf = append(f.buf[:0], f.buf[size:]...)
+		f.in = false
+	}
+
+	return len(p), nil
+}
+
+// scan looks for the end-of-image marker closing the frame's start-of-image,
+// resuming where the last call stopped. It returns the frame's size, or -1 if
+// the frame isn't complete yet
+func (f *frameSplitter) scan() int {
+	for {
+		idx := bytes.IndexByte(f.buf[f.pos:], 0xFF)
+		if idx < 0 || f.pos+idx+1 >= len(f.buf) {
+			// keep a trailing 0xFF for the next write
+			if idx >= 0 {
+				f.pos += idx
+			} else {
+				f.pos = len(f.buf)
+			}
+			return -1
+		}
+
+		f.pos += idx
+
+		switch f.buf[f.pos+1] {
+		case soi[1]:
+			f.depth++
+			f.pos += len(soi)
+		case eoi[1]:
+			f.depth--
+			f.pos += len(eoi)
+
+			if f.depth == 0 {
+				return f.pos
+			}
+		default:
+			f.pos++
+		}
+	}
+}
+
+// serveMJPEG streams the live frames as a multipart/x-mixed-replace response,
+// which browsers and players such as VLC display as a video
+func (s *StreamService) serveMJPEG(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+
+	if s.live == nil {
+		writeResponse(w, http.StatusNotFound, &apiError{Error: "live view is not available"})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeResponse(w, http.StatusInternalServerError, &apiError{Error: "streaming is not supported"})
+		return
+	}
+
+	frames, unsubscribe := s.live.Subscribe()
+	defer unsubscribe()
+
+	logCh <- log.NewMessage().Level(log.LLDebug).Sub("serveMJPEG()").Message("live viewer connected").Metadata(log.Field{"remote": r.RemoteAddr, "viewers": s.live.Viewers()}).Build()
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			logCh <- log.NewMessage().Level(log.LLDebug).Sub("serveMJPEG()").Message("live viewer disconnected").Metadata(log.Field{"remote": r.RemoteAddr}).Build()
+			return
+		case frame := <-frames:
+			_, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(frame))
+			if err == nil {
+				_, err = w.Write(frame)
+			}
+			if err == nil {
+				_, err = w.Write([]byte("\r\n"))
+			}
+			if err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+// serveSnapshot returns the latest live frame as a JPEG image
+func (s *StreamService) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+
+	var frame []byte
+	if s.live != nil {
+		frame = s.live.Last()
+	}
+
+	if frame == nil {
+		writeResponse(w, http.StatusNotFound, &apiError{Error: "no live frame available"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(frame)))
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != http.MethodHead {
+		w.Write(frame)
+	}
+}
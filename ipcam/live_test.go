@@ -0,0 +1,88 @@
+package ipcam
+
+import (
+	"bytes"
+	"testing"
+)
+
+// jpeg returns a fake JPEG image holding body between its markers
+func jpeg(body ...byte) []byte {
+	return append(append(append([]byte{}, soi...), body...), eoi...)
+}
+
+// split feeds stream to a frameSplitter in chunks of size bytes, returning the
+// published frames
+func split(stream []byte, size int) [][]byte {
+	b := NewBroadcaster()
+	f := b.writer()
+
+	var frames [][]byte
+	var last []byte
+
+	for len(stream) > 0 {
+		n := size
+		if n > len(stream) {
+			n = len(stream)
+		}
+
+		f.Write(stream[:n])
+		stream = stream[n:]
+
+		// chunks are smaller than a frame, so each write publishes at most one
+		if frame := b.Last(); frame != nil && (last == nil || &frame[0] != &last[0]) {
+			frames = append(frames, frame)
+			last = frame
+		}
+	}
+
+	return frames
+}
+
+func TestFrameSplitter(t *testing.T) {
+	plain := jpeg(0xFF, 0xE0, 0x01, 0x02, 0x03, 0x04)
+
+	// an APP1 (EXIF) segment with an embedded thumbnail, which has its own markers
+	thumbnail := jpeg(0xFF, 0xE1, 0x00, 0x10)
+	thumbnail = append(thumbnail[:len(thumbnail)-len(eoi)], jpeg(0x10, 0x20, 0x30)...)
+	thumbnail = append(thumbnail, 0xFF, 0xDA, 0x40, 0x50, 0xFF, 0x00, 0x60)
+	thumbnail = append(thumbnail, eoi...)
+
+	// a stray 0xFF, and a marker split across writes, are kept
+	stray := jpeg(0xFF, 0xFF, 0xE0, 0x11, 0xFF)
+
+	var stream bytes.Buffer
+	for _, frame := range [][]byte{plain, thumbnail, stray} {
+		stream.WriteString("--boundary\r\nContent-Type: image/jpeg\r\n\r\n")
+		stream.Write(frame)
+		stream.WriteString("\r\n")
+	}
+
+	for _, size := range []int{1, 2, 3, 5} {
+		frames := split(stream.Bytes(), size)
+
+		if len(frames) != 3 {
+			t.Errorf("chunks of %d: got %d frames, want 3", size, len(frames))
+			continue
+		}
+
+		for n, want := range [][]byte{plain, thumbnail, stray} {
+			if !bytes.Equal(frames[n], want) {
+				t.Errorf("chunks of %d: frame %d: got % X, want % X", size, n, frames[n], want)
+			}
+		}
+	}
+}
+
+func TestFrameSplitterOverflow(t *testing.T) {
+	b := NewBroadcaster()
+	f := b.writer()
+
+	// a frame which never ends is dropped, and the next one is found
+	f.Write(soi)
+	f.Write(make([]byte, maxFrameSize))
+	f.Write(jpeg(0x01))
+
+	if last := b.Last(); !bytes.Equal(last, jpeg(0x01)) {
+		t.Errorf("got % X, want % X", last, jpeg(0x01))
+	}
+}
@@ -0,0 +1,21 @@
+package ipcam
+
+import (
+	"os"
+	"testing"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+// TestMain discards the log messages, which are otherwise sent to a nil channel
+// until New is called
+func TestMain(m *testing.M) {
+	logCh = make(chan *log.LogMessage, 64)
+
+	go func() {
+		for range logCh {
+		}
+	}()
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,219 @@
+package ipcam
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the recorder's metrics, exposed in the Prometheus text format at /metrics
+var (
+	trackBytes       = newCounter("ipcam_track_received_bytes_total", "Bytes received from the camera, per track", "track")
+	trackConnects    = newCounter("ipcam_track_connects_total", "Successful connections to the camera, per track", "track")
+	trackReconnects  = newCounter("ipcam_track_reconnects_total", "Times the camera track went offline and started reconnecting, per track", "track")
+	backoffAttempts  = newCounter("ipcam_backoff_attempts_total", "Calls retried by the exponential backoff", "")
+	segmentsTotal    = newCounter("ipcam_segments_total", "Recorded segments, by how they ended (deadline or cut)", "end")
+	mergesTotal      = newCounter("ipcam_merges_total", "Finished merges, by result (merged or failed)", "result")
+	mergeAttempts    = newCounter("ipcam_merge_attempts_total", "Merge attempts, including retries", "")
+	retentionDeletes = newCounter("ipcam_retention_deletions_total", "Recordings removed by retention, by reason", "reason")
+	retentionFreed   = newCounter("ipcam_retention_freed_bytes_total", "Bytes freed by retention", "")
+	eventsDropped    = newCounter("ipcam_events_dropped_total", "Events dropped because their subscriber fell behind, per subscriber", "subscriber")
+
+	segmentDuration = newHistogram("ipcam_segment_duration_seconds", "Duration of the recorded segments", []float64{30, 60, 300, 600, 900, 1800, 3600, 7200})
+	mergeDuration   = newHistogram("ipcam_merge_duration_seconds", "Duration of the merges, including retries", []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800})
+)
+
+// counter is a monotonic counter, optionally partitioned by a single label
+type counter struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+}
+
+func newCounter(name, help, label string) *counter {
+	return &counter{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: map[string]float64{},
+	}
+}
+
+func (c *counter) Add(label string, v float64) {
+	c.mu.Lock()
+	c.values[label] += v
+	c.mu.Unlock()
+}
+
+func (c *counter) Inc(label string) {
+	c.Add(label, 1)
+}
+
+// Sum returns the counter's total across its labels
+func (c *counter) Sum() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var sum float64
+	for _, v := range c.values {
+		sum += v
+	}
+	return sum
+}
+
+func (c *counter) write(w io.Writer, labels string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	if c.label == "" {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, labels, formatFloat(c.values[""]))
+		return
+	}
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s,%s} %s\n", c.name, labels, label(c.label, k), formatFloat(c.values[k]))
+	}
+}
+
+// histogram counts observations in cumulative buckets
+type histogram struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s,%s} %d\n", h.name, labels, label("le", formatFloat(b)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,%s} %d\n", h.name, labels, label("le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, labels, h.count)
+}
+
+func writeGauge(w io.Writer, name, help, labels string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s{%s} %s\n", name, help, name, name, labels, formatFloat(v))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteMetrics writes the recorder's metrics in the Prometheus text format
+func (s *StreamService) WriteMetrics(w io.Writer) {
+	labels := label("camera", sanitize(s.request.Camera))
+
+	for _, c := range []*counter{trackBytes, trackConnects, trackReconnects, backoffAttempts, segmentsTotal, mergesTotal, mergeAttempts, retentionDeletes, retentionFreed, eventsDropped} {
+		c.write(w, labels)
+	}
+
+	for _, h := range []*histogram{segmentDuration, mergeDuration} {
+		h.write(w, labels)
+	}
+
+	status := s.Status()
+
+	writeGauge(w, "ipcam_recording", "Whether the recorder is recording (1) or stopped (0)", labels, boolGauge(status.Recording))
+	writeGauge(w, "ipcam_degraded", "Whether low disk space forced the degraded merge profile", labels, boolGauge(status.Degraded))
+	writeGauge(w, "ipcam_pending_merges", "Segments waiting to be merged", labels, float64(len(status.Pending)))
+	writeGauge(w, "ipcam_live_viewers", "Viewers of the live MJPEG stream", labels, float64(status.Viewers))
+
+	if status.Segment != nil {
+		fmt.Fprintf(w, "# HELP ipcam_track_connected Whether the camera track is connected\n# TYPE ipcam_track_connected gauge\n")
+		fmt.Fprintf(w, "ipcam_track_connected{%s,%s} %s\n", labels, label("track", "video"), formatFloat(boolGauge(status.Segment.Video.Connected)))
+		fmt.Fprintf(w, "ipcam_track_connected{%s,%s} %s\n", labels, label("track", "audio"), formatFloat(boolGauge(status.Segment.Audio.Connected)))
+	}
+
+	fmt.Fprintf(w, "# HELP ipcam_disk_total_bytes Size of the filesystem\n# TYPE ipcam_disk_total_bytes gauge\n")
+	for _, path := range s.diskPaths() {
+		if usage, err := diskUsage(path); err == nil {
+			fmt.Fprintf(w, "ipcam_disk_total_bytes{%s,%s} %d\n", labels, label("path", path), usage.Total)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP ipcam_disk_free_bytes Free space in the filesystem\n# TYPE ipcam_disk_free_bytes gauge\n")
+	for _, path := range s.diskPaths() {
+		if usage, err := diskUsage(path); err == nil {
+			fmt.Fprintf(w, "ipcam_disk_free_bytes{%s,%s} %d\n", labels, label("path", path), usage.Free)
+		}
+	}
+}
+
+func (s *StreamService) diskPaths() []string {
+	if s.request.TmpDir == s.request.OutDir {
+		return []string{s.request.OutDir}
+	}
+	return []string{s.request.TmpDir, s.request.OutDir}
+}
+
+func (s *StreamService) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	s.WriteMetrics(w)
+}
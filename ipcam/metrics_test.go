@@ -0,0 +1,94 @@
+package ipcam
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	labels := label("camera", `front "door"`)
+
+	plain := newCounter("test_plain_total", "Unlabelled counter", "")
+
+	c := newCounter("test_total", "Labelled counter", "track")
+	c.Add("c\\d\ne", 2)
+	c.Inc(`a"b`)
+
+	h := newHistogram("test_seconds", "Test histogram", []float64{1, 5, 10})
+	for _, v := range []float64{0.5, 5, 7, 100} {
+		h.Observe(v)
+	}
+
+	buf := &bytes.Buffer{}
+	plain.write(buf, labels)
+	c.write(buf, labels)
+	h.write(buf, labels)
+
+	want := `# HELP test_plain_total Unlabelled counter
+# TYPE test_plain_total counter
+test_plain_total{camera="front \"door\""} 0
+# HELP test_total Labelled counter
+# TYPE test_total counter
+test_total{camera="front \"door\"",track="a\"b"} 1
+test_total{camera="front \"door\"",track="c\\d\ne"} 2
+# HELP test_seconds Test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{camera="front \"door\"",le="1"} 1
+test_seconds_bucket{camera="front \"door\"",le="5"} 2
+test_seconds_bucket{camera="front \"door\"",le="10"} 3
+test_seconds_bucket{camera="front \"door\"",le="+Inf"} 4
+test_seconds_sum{camera="front \"door\""} 112.5
+test_seconds_count{camera="front \"door\""} 4
+`
+
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	s := testService("front")
+
+	buf := &bytes.Buffer{}
+	s.WriteMetrics(buf)
+
+	// every family is described once, with its HELP and TYPE before its samples
+	described := map[string]bool{}
+	var family string
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+
+	for n, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			family = strings.Fields(line)[2]
+			if described[family] {
+				t.Errorf("line %d: %s described more than once", n+1, family)
+			}
+			described[family] = true
+
+			if n+1 >= len(lines) || !strings.HasPrefix(lines[n+1], "# TYPE "+family+" ") {
+				t.Errorf("line %d: %s has no TYPE after its HELP", n+1, family)
+			}
+		case strings.HasPrefix(line, "# TYPE "):
+			if name := strings.Fields(line)[2]; name != family {
+				t.Errorf("line %d: TYPE for %s without its HELP", n+1, name)
+			}
+		default:
+			name := line[:strings.IndexAny(line, "{ ")]
+			if name != family && !strings.HasPrefix(name, family+"_") {
+				t.Errorf("line %d: sample %s outside its family %s", n+1, name, family)
+			}
+			if !strings.Contains(line, `camera="front"`) {
+				t.Errorf("line %d: sample without the camera label: %s", n+1, line)
+			}
+		}
+	}
+
+	for _, name := range []string{"ipcam_track_reconnects_total", "ipcam_segment_duration_seconds", "ipcam_recording", "ipcam_pending_merges"} {
+		if !described[name] {
+			t.Errorf("missing %s", name)
+		}
+	}
+}
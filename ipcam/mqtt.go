@@ -0,0 +1,288 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/zalgonoise/zlog/log"
+)
+
+const (
+	defaultMQTTPrefix = "ipcam"
+
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+
+	// mqttStateInterval is how often the recorder's state is refreshed, so that
+	// counters such as the received bytes stay current
+	mqttStateInterval = 30 * time.Second
+	mqttTimeout       = 5 * time.Second
+)
+
+// MQTTConfig configures the MQTT publisher. Topics default to
+// <prefix>/<camera>/availability, <prefix>/<camera>/state and
+// <prefix>/<camera>/events/<event type>, and can be overridden in Topics with
+// the keys "availability", "state", "sensors" or an event type. If Discovery is
+// set, the camera is also announced to Home Assistant
+type MQTTConfig struct {
+	Broker   string            `json:"broker"`
+	ClientID string            `json:"clientID,omitempty"`
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Prefix   string            `json:"prefix,omitempty"`
+	QoS      byte              `json:"qos,omitempty"`
+	Events   []EventType       `json:"events,omitempty"`
+	Topics   map[string]string `json:"topics,omitempty"`
+
+	Discovery       bool   `json:"discovery,omitempty"`
+	DiscoveryPrefix string `json:"discoveryPrefix,omitempty"`
+}
+
+func (c *MQTTConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+
+	u, err := url.Parse(c.Broker)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return fmt.Errorf("unsupported MQTT broker scheme %q", u.Scheme)
+	}
+
+	if c.QoS > 2 {
+		return fmt.Errorf("invalid MQTT QoS %d", c.QoS)
+	}
+
+	for _, e := range c.Events {
+		if !knownEvents[e] {
+			return fmt.Errorf("unknown event type %q", e)
+		}
+	}
+
+	for key := range c.Topics {
+		if key != "availability" && key != "state" && key != "sensors" && !knownEvents[EventType(key)] {
+			return fmt.Errorf("unknown MQTT topic key %q", key)
+		}
+	}
+
+	return nil
+}
+
+// mqttPublisher publishes the recorder's availability (retained, with a last
+// will so that the broker flags it offline if the connection drops), its state
+// and sensor readings (retained) and its events to a MQTT broker
+type mqttPublisher struct {
+	cfg    *MQTTConfig
+	base   string
+	client mqtt.Client
+	svc    *StreamService
+
+	mu        sync.Mutex
+	lastBytes float64
+	lastTime  time.Time
+}
+
+func newMQTTPublisher(cfg *MQTTConfig, svc *StreamService) *mqttPublisher {
+	camera := svc.request.Camera
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultMQTTPrefix
+	}
+
+	p := &mqttPublisher{
+		cfg:  cfg,
+		base: strings.TrimSuffix(prefix, "/") + "/" + topicName(camera),
+		svc:  svc,
+	}
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = "ipcam-stream-" + topicName(camera)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(clientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetWill(p.topic("availability"), mqttOffline, cfg.QoS, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetOnConnectHandler(func(mqtt.Client) {
+			logCh <- log.NewMessage().Sub("mqtt()").Message("connected to MQTT broker").Metadata(log.Field{"broker": cfg.Broker}).Build()
+
+			p.publish(p.topic("availability"), true, []byte(mqttOnline))
+			p.publishState()
+			p.publishSensors()
+
+			if cfg.Discovery {
+				p.discover()
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("mqtt()").Message("lost connection to MQTT broker").Metadata(log.Field{"broker": cfg.Broker, "error": err.Error()}).Build()
+		})
+
+	p.client = mqtt.NewClient(opts)
+
+	return p
+}
+
+// topicName turns name into a single topic level, free of separators and
+// wildcards
+func topicName(name string) string {
+	return strings.NewReplacer("+", "_", "#", "_", " ", "_").Replace(sanitize(name))
+}
+
+// topic returns the topic for key ("availability", "state", "sensors" or an
+// event type)
+func (p *mqttPublisher) topic(key string) string {
+	if t, ok := p.cfg.Topics[key]; ok {
+		return t
+	}
+
+	switch key {
+	case "availability", "state", "sensors":
+		return p.base + "/" + key
+	}
+	return p.base + "/events/" + key
+}
+
+func (p *mqttPublisher) accepts(e *Event) bool {
+	if len(p.cfg.Events) == 0 {
+		return true
+	}
+
+	for _, t := range p.cfg.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// start connects to the broker (retrying in the background) and publishes the
+// events from bus, as well as the state and sensors every mqttStateInterval
+func (p *mqttPublisher) start(bus *EventBus) {
+	p.lastTime = time.Now()
+
+	logCh <- log.NewMessage().Sub("mqtt()").Message("connecting to MQTT broker").Metadata(log.Field{"broker": p.cfg.Broker, "topic": p.base}).Build()
+
+	p.client.Connect()
+
+	bus.Handle("mqtt", func(e *Event) {
+		if p.accepts(e) {
+			if data, err := json.Marshal(e); err == nil {
+				p.publish(p.topic(string(e.Type)), false, data)
+			}
+		}
+
+		p.publishState()
+	})
+
+	go func() {
+		defer logPanics("mqtt()")
+
+		for range time.Tick(mqttStateInterval) {
+			p.publishState()
+			p.publishSensors()
+		}
+	}()
+}
+
+func (p *mqttPublisher) publishState() {
+	data, err := json.Marshal(p.svc.Status())
+	if err != nil {
+		return
+	}
+
+	p.publish(p.topic("state"), true, data)
+}
+
+// Sensors are the readings published to the sensors topic
+type Sensors struct {
+	// Bitrate is the rate received from the camera since the last reading, in kbit/s
+	Bitrate float64 `json:"bitrate"`
+	// DiskUsage is the used space in the output directory's filesystem, in percent
+	DiskUsage float64 `json:"diskUsage"`
+	DiskFree  uint64  `json:"diskFree"`
+}
+
+func (p *mqttPublisher) publishSensors() {
+	p.mu.Lock()
+
+	now := time.Now()
+	bytes := trackBytes.Sum()
+
+	sensors := &Sensors{}
+	if elapsed := now.Sub(p.lastTime).Seconds(); elapsed > 0 {
+		sensors.Bitrate = math.Round((bytes-p.lastBytes)*8/1000/elapsed*10) / 10
+	}
+
+	p.lastBytes = bytes
+	p.lastTime = now
+
+	p.mu.Unlock()
+
+	if usage, err := diskUsage(p.svc.request.OutDir); err == nil && usage.Total > 0 {
+		sensors.DiskUsage = math.Round(float64(usage.Used)/float64(usage.Total)*1000) / 10
+		sensors.DiskFree = usage.Free
+	}
+
+	data, err := json.Marshal(sensors)
+	if err != nil {
+		return
+	}
+
+	p.publish(p.topic("sensors"), true, data)
+}
+
+// publish sends payload to topic. While the connection is down, QoS 0 messages
+// are dropped (the state is published again on reconnection), and others are
+// queued by the client
+func (p *mqttPublisher) publish(topic string, retained bool, payload []byte) {
+	connected := p.client.IsConnectionOpen()
+	if !connected && p.cfg.QoS == 0 {
+		return
+	}
+
+	token := p.client.Publish(topic, p.cfg.QoS, retained, payload)
+	if !connected {
+		return
+	}
+
+	go func() {
+		if !token.WaitTimeout(mqttTimeout) {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("mqtt()").Message("timed out publishing MQTT message").Metadata(log.Field{"topic": topic}).Build()
+			return
+		}
+
+		if err := token.Error(); err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("mqtt()").Message("failed to publish MQTT message").Metadata(log.Field{"topic": topic, "error": err.Error()}).Build()
+		}
+	}()
+}
+
+// Close marks the recorder offline and disconnects; a graceful disconnect
+// doesn't trigger the last will
+func (p *mqttPublisher) Close() {
+	if p == nil || !p.client.IsConnectionOpen() {
+		return
+	}
+
+	p.client.Publish(p.topic("availability"), p.cfg.QoS, true, []byte(mqttOffline)).WaitTimeout(mqttTimeout)
+	p.client.Disconnect(250)
+}
@@ -0,0 +1,280 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeBroker is a minimal in-process MQTT broker for a single client, which
+// records the client's connection and published messages
+type fakeBroker struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu       sync.Mutex
+	conn     net.Conn
+	connect  *packets.ConnectPacket
+	messages chan *packets.PublishPacket
+	subs     chan string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBroker{
+		t:        t,
+		ln:       ln,
+		messages: make(chan *packets.PublishPacket, 100),
+		subs:     make(chan string, 100),
+	}
+
+	go b.serve()
+	t.Cleanup(func() { ln.Close() })
+
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *fakeBroker) serve() {
+	conn, err := b.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch pk := p.(type) {
+		case *packets.ConnectPacket:
+			b.mu.Lock()
+			b.connect = pk
+			b.mu.Unlock()
+
+			b.write(packets.NewControlPacket(packets.Connack))
+		case *packets.PublishPacket:
+			b.messages <- pk
+
+			if pk.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = pk.MessageID
+				b.write(ack)
+			}
+		case *packets.SubscribePacket:
+			for _, topic := range pk.Topics {
+				b.subs <- topic
+			}
+
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = pk.MessageID
+			ack.ReturnCodes = make([]byte, len(pk.Topics))
+			b.write(ack)
+		case *packets.PingreqPacket:
+			b.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) write(p packets.ControlPacket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p.Write(b.conn)
+}
+
+// send publishes a message to the client
+func (b *fakeBroker) send(topic, payload string) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+
+	b.write(p)
+}
+
+// next returns the next message published to topic, skipping others
+func (b *fakeBroker) next(topic string) *packets.PublishPacket {
+	b.t.Helper()
+
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case p := <-b.messages:
+			if p.TopicName == topic {
+				return p
+			}
+		case <-timeout:
+			b.t.Fatalf("timed out waiting for a message on %s", topic)
+			return nil
+		}
+	}
+}
+
+// subscribed waits for the client to subscribe to topic
+func (b *fakeBroker) subscribed(topic string) {
+	b.t.Helper()
+
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case s := <-b.subs:
+			if s == topic {
+				return
+			}
+		case <-timeout:
+			b.t.Fatalf("timed out waiting for a subscription to %s", topic)
+		}
+	}
+}
+
+func testService(camera string) *StreamService {
+	s := &StreamService{
+		request: &StreamRequest{Camera: camera, OutDir: "."},
+		control: newControl(),
+		Events:  NewEventBus(),
+	}
+	s.Events.camera = camera
+
+	return s
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker := newFakeBroker(t)
+
+	s := testService("Front Door")
+	p := newMQTTPublisher(&MQTTConfig{Broker: broker.url(), QoS: 1}, s)
+	p.start(s.Events)
+
+	availability := broker.next("ipcam/Front_Door/availability")
+	if string(availability.Payload) != mqttOnline || !availability.Retain {
+		t.Errorf("availability: got %q (retained: %v), want retained %q", availability.Payload, availability.Retain, mqttOnline)
+	}
+
+	broker.mu.Lock()
+	connect := broker.connect
+	broker.mu.Unlock()
+
+	if !connect.WillFlag || connect.WillTopic != "ipcam/Front_Door/availability" || string(connect.WillMessage) != mqttOffline || !connect.WillRetain {
+		t.Errorf("unexpected last will: topic %q, message %q, retained %v", connect.WillTopic, connect.WillMessage, connect.WillRetain)
+	}
+
+	if connect.ClientIdentifier != "ipcam-stream-Front_Door" {
+		t.Errorf("unexpected client ID %q", connect.ClientIdentifier)
+	}
+
+	state := broker.next("ipcam/Front_Door/state")
+	if !state.Retain {
+		t.Error("state isn't retained")
+	}
+
+	status := &Status{}
+	if err := json.Unmarshal(state.Payload, status); err != nil || status.Camera != "Front Door" || !status.Recording {
+		t.Errorf("unexpected state %s (%v)", state.Payload, err)
+	}
+
+	sensors := broker.next("ipcam/Front_Door/sensors")
+	if !sensors.Retain {
+		t.Error("sensors aren't retained")
+	}
+
+	if err := s.StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+
+	event := broker.next("ipcam/Front_Door/events/recording.stopped")
+	if event.Retain {
+		t.Error("event is retained")
+	}
+
+	e := &Event{}
+	if err := json.Unmarshal(event.Payload, e); err != nil || e.Type != EventPaused || e.Camera != "Front Door" {
+		t.Errorf("unexpected event %s (%v)", event.Payload, err)
+	}
+
+	state = broker.next("ipcam/Front_Door/state")
+	if err := json.Unmarshal(state.Payload, status); err != nil || status.Recording {
+		t.Errorf("state not updated after the event: %s", state.Payload)
+	}
+
+	p.Close()
+
+	availability = broker.next("ipcam/Front_Door/availability")
+	if string(availability.Payload) != mqttOffline || !availability.Retain {
+		t.Errorf("availability on close: got %q (retained: %v), want retained %q", availability.Payload, availability.Retain, mqttOffline)
+	}
+}
+
+func TestMQTTTopics(t *testing.T) {
+	s := testService("cam")
+	p := newMQTTPublisher(&MQTTConfig{
+		Broker: "tcp://localhost:1883",
+		Prefix: "home/",
+		Topics: map[string]string{"state": "custom/state", string(EventDiskLow): "alerts/disk"},
+	}, s)
+
+	for key, want := range map[string]string{
+		"availability":         "home/cam/availability",
+		"state":                "custom/state",
+		"sensors":              "home/cam/sensors",
+		string(EventMerged):    "home/cam/events/segment.merged",
+		string(EventDiskLow):   "alerts/disk",
+		string(EventOffline):   "home/cam/events/camera.offline",
+		string(EventRecording): "home/cam/events/recording.started",
+	} {
+		if got := p.topic(key); got != want {
+			t.Errorf("topic(%q): got %q, want %q", key, got, want)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"cam":        "cam",
+		"front door": "front_door",
+		"a/b":        "a_b",
+		"a+b#c":      "a_b_c",
+	} {
+		if got := topicName(name); got != want {
+			t.Errorf("topicName(%q): got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMQTTConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		cfg *MQTTConfig
+		ok  bool
+	}{
+		{nil, true},
+		{&MQTTConfig{Broker: "tcp://localhost:1883"}, true},
+		{&MQTTConfig{Broker: "mqtts://broker:8883", QoS: 2, Events: []EventType{EventMerged}}, true},
+		{&MQTTConfig{Broker: "http://localhost"}, false},
+		{&MQTTConfig{Broker: "tcp://localhost:1883", QoS: 3}, false},
+		{&MQTTConfig{Broker: "tcp://localhost:1883", Events: []EventType{"nope"}}, false},
+		{&MQTTConfig{Broker: "tcp://localhost:1883", Topics: map[string]string{"sensors": "x"}}, true},
+		{&MQTTConfig{Broker: "tcp://localhost:1883", Topics: map[string]string{"nope": "x"}}, false},
+	} {
+		if err := test.cfg.Validate(); (err == nil) != test.ok {
+			t.Errorf("%+v: got error %v, want ok = %v", test.cfg, err, test.ok)
+		}
+	}
+}
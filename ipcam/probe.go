@@ -0,0 +1,99 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// tolerance is the allowed fraction of difference between the expected and the
+// probed duration of a recording
+const tolerance = 0.05
+
+type ProbeResult struct {
+	Duration   float64  `json:"duration"`
+	Expected   float64  `json:"expected"`
+	Streams    int      `json:"streams"`
+	VideoCodec string   `json:"videoCodec,omitempty"`
+	AudioCodec string   `json:"audioCodec,omitempty"`
+	Frames     int64    `json:"frames"`
+	Mismatch   []string `json:"mismatch,omitempty"`
+}
+
+type ffprobeOutput struct {
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		NbFrames  string `json:"nb_frames"`
+	} `json:"streams"`
+}
+
+func probe(path string, expected time.Duration) (*ProbeResult, error) {
+	out, err := ffmpeg.Probe(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &ffprobeOutput{}
+	if err := json.Unmarshal([]byte(out), data); err != nil {
+		return nil, err
+	}
+
+	res := &ProbeResult{
+		Expected: expected.Seconds(),
+		Streams:  len(data.Streams),
+	}
+
+	if data.Format.Duration != "" {
+		if res.Duration, err = strconv.ParseFloat(data.Format.Duration, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, stream := range data.Streams {
+		switch stream.CodecType {
+		case "video":
+			res.VideoCodec = stream.CodecName
+			res.Frames, _ = strconv.ParseInt(stream.NbFrames, 10, 64)
+		case "audio":
+			res.AudioCodec = stream.CodecName
+		}
+	}
+
+	res.check()
+
+	return res, nil
+}
+
+func (r *ProbeResult) check() {
+	if r.Streams < 2 {
+		r.Mismatch = append(r.Mismatch, fmt.Sprintf("expected 2 streams, found %d", r.Streams))
+	}
+
+	if r.VideoCodec == "" {
+		r.Mismatch = append(r.Mismatch, "no video stream found")
+	}
+
+	if r.AudioCodec == "" {
+		r.Mismatch = append(r.Mismatch, "no audio stream found")
+	}
+
+	if r.Frames == 0 {
+		r.Mismatch = append(r.Mismatch, "video stream has no frames")
+	}
+
+	if r.Expected > 0 && math.Abs(r.Duration-r.Expected) > r.Expected*tolerance {
+		r.Mismatch = append(r.Mismatch, fmt.Sprintf("expected a duration of %.1fs, found %.1fs", r.Expected, r.Duration))
+	}
+}
+
+func (r *ProbeResult) OK() bool {
+	return len(r.Mismatch) == 0
+}
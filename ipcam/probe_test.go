@@ -0,0 +1,39 @@
+package ipcam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProbeResultCheck(t *testing.T) {
+	ok := func() *ProbeResult {
+		return &ProbeResult{Duration: 60, Expected: 60, Streams: 2, VideoCodec: "h264", AudioCodec: "aac", Frames: 1500}
+	}
+
+	for _, test := range []struct {
+		name   string
+		modify func(r *ProbeResult)
+		want   []string
+	}{
+		{"as expected", func(r *ProbeResult) {}, nil},
+		{"within the tolerance", func(r *ProbeResult) { r.Duration = 57.5 }, nil},
+		{"unknown expected duration", func(r *ProbeResult) { r.Expected = 0; r.Duration = 5 }, nil},
+		{"too short", func(r *ProbeResult) { r.Duration = 50 }, []string{"expected a duration of 60.0s, found 50.0s"}},
+		{"too long", func(r *ProbeResult) { r.Duration = 63.5 }, []string{"expected a duration of 60.0s, found 63.5s"}},
+		{"no frames", func(r *ProbeResult) { r.Frames = 0 }, []string{"video stream has no frames"}},
+		{"video only", func(r *ProbeResult) { r.Streams = 1; r.AudioCodec = "" }, []string{"expected 2 streams, found 1", "no audio stream found"}},
+		{"audio only", func(r *ProbeResult) { r.Streams = 1; r.VideoCodec = ""; r.Frames = 0 }, []string{"expected 2 streams, found 1", "no video stream found", "video stream has no frames"}},
+	} {
+		r := ok()
+		test.modify(r)
+		r.check()
+
+		if !reflect.DeepEqual(r.Mismatch, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, r.Mismatch, test.want)
+		}
+
+		if r.OK() != (len(test.want) == 0) {
+			t.Errorf("%s: OK() = %v with mismatches %q", test.name, r.OK(), r.Mismatch)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ipcam
+
+import (
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+type MergeProfile struct {
+	Name   string        `json:"name"`
+	Output ffmpeg.KwArgs `json:"output"`
+}
+
+var DefaultProfile = &MergeProfile{
+	Name: "libx264",
+	Output: ffmpeg.KwArgs{
+		"input_format": "1",
+		"b:v":          "4000k",
+		"c:v":          "libx264",
+		"c:a":          "aac",
+		"pix_fmt":      "yuv420p",
+	},
+}
+
+var FallbackProfile = &MergeProfile{
+	Name: "libx264-ultrafast",
+	Output: ffmpeg.KwArgs{
+		"b:v":     "2000k",
+		"c:v":     "libx264",
+		"preset":  "ultrafast",
+		"c:a":     "aac",
+		"pix_fmt": "yuv420p",
+	},
+}
+
+var LowDiskProfile = &MergeProfile{
+	Name: "libx264-lowdisk",
+	Output: ffmpeg.KwArgs{
+		"b:v":     "1000k",
+		"c:v":     "libx264",
+		"preset":  "ultrafast",
+		"c:a":     "aac",
+		"b:a":     "64k",
+		"pix_fmt": "yuv420p",
+	},
+}
+
+var ArchiveProfile = &MergeProfile{
+	Name: "archive",
+	Output: ffmpeg.KwArgs{
+		"vf":      "scale=-2:480,fps=5",
+		"b:v":     "500k",
+		"c:v":     "libx264",
+		"preset":  "veryslow",
+		"c:a":     "aac",
+		"b:a":     "48k",
+		"pix_fmt": "yuv420p",
+	},
+}
+
+var ArchiveLowProfile = &MergeProfile{
+	Name: "archive-low",
+	Output: ffmpeg.KwArgs{
+		"vf":      "scale=-2:360,fps=1",
+		"b:v":     "150k",
+		"c:v":     "libx264",
+		"preset":  "veryslow",
+		"c:a":     "aac",
+		"b:a":     "32k",
+		"ac":      "1",
+		"pix_fmt": "yuv420p",
+	},
+}
+
+var Profiles = map[string]*MergeProfile{
+	DefaultProfile.Name:    DefaultProfile,
+	FallbackProfile.Name:   FallbackProfile,
+	LowDiskProfile.Name:    LowDiskProfile,
+	ArchiveProfile.Name:    ArchiveProfile,
+	ArchiveLowProfile.Name: ArchiveLowProfile,
+}
@@ -0,0 +1,133 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const protectFile = "protected.json"
+
+// Protection marks a recording, or a time range of a camera's recordings, as
+// protected from rotation and quota enforcement
+type Protection struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path,omitempty"`
+	Camera  string    `json:"camera,omitempty"`
+	From    time.Time `json:"from,omitempty"`
+	To      time.Time `json:"to,omitempty"`
+	Note    string    `json:"note,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type Protections struct {
+	mu      sync.Mutex
+	path    string
+	Entries []*Protection `json:"entries"`
+}
+
+func OpenProtections(root string) (*Protections, error) {
+	p := &Protections{path: filepath.Join(root, protectFile)}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return p, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Add stores a new protection, for either a recording's path or a time range
+func (p *Protections) Add(e *Protection) (*Protection, error) {
+	if e.Path == "" && (e.From.IsZero() || e.To.IsZero()) {
+		return nil, errors.New("protection needs either a recording path or a time range")
+	}
+
+	if e.Path == "" && !e.From.Before(e.To) {
+		return nil, errors.New("protection range start must be before its end")
+	}
+
+	if e.Path != "" {
+		abs, err := filepath.Abs(e.Path)
+		if err != nil {
+			return nil, err
+		}
+		e.Path = abs
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.Created = time.Now()
+	e.ID = strconv.FormatInt(e.Created.UnixNano(), 36)
+
+	p.Entries = append(p.Entries, e)
+
+	return e, p.save()
+}
+
+func (p *Protections) Remove(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for n, e := range p.Entries {
+		if e.ID == id {
+			p.Entries = append(p.Entries[:n], p.Entries[n+1:]...)
+			return p.save()
+		}
+	}
+
+	return fmt.Errorf("protection %q not found", id)
+}
+
+func (p *Protections) List() []*Protection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]*Protection{}, p.Entries...)
+}
+
+// Covers returns the protection covering a recording of camera at path, spanning
+// from start to end, if any
+func (p *Protections) Covers(path, camera string, start, end time.Time) *Protection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	abs, _ := filepath.Abs(path)
+
+	for _, e := range p.Entries {
+		if e.Path != "" {
+			if e.Path == abs {
+				return e
+			}
+			continue
+		}
+
+		if e.Camera != "" && e.Camera != camera {
+			continue
+		}
+
+		if start.Before(e.To) && end.After(e.From) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (p *Protections) save() error {
+	return writeJSONAtomic(p.path, p)
+}
@@ -0,0 +1,113 @@
+package ipcam
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProtectionsCovers(t *testing.T) {
+	p, err := OpenProtections(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(h, m int) time.Time {
+		return time.Date(2022, 5, 30, h, m, 0, 0, time.UTC)
+	}
+
+	for _, e := range []*Protection{
+		{Path: "/out/front/2022-05-30/a.mp4"},
+		{Camera: "front", From: at(10, 30), To: at(11, 30)},
+		{From: at(20, 0), To: at(21, 0)},
+	} {
+		if _, err := p.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name       string
+		path       string
+		camera     string
+		start, end time.Time
+		want       bool
+	}{
+		{"by path", "/out/front/2022-05-30/a.mp4", "front", at(1, 0), at(2, 0), true},
+		{"other path", "/out/front/2022-05-30/b.mp4", "front", at(1, 0), at(2, 0), false},
+		{"range partly overlapping the start", "x", "front", at(10, 0), at(11, 0), true},
+		{"range partly overlapping the end", "x", "front", at(11, 0), at(12, 0), true},
+		{"range within the segment", "x", "front", at(10, 0), at(12, 0), true},
+		{"segment ending at the range start", "x", "front", at(9, 30), at(10, 30), false},
+		{"segment starting at the range end", "x", "front", at(11, 30), at(12, 30), false},
+		{"other camera", "x", "back", at(10, 0), at(11, 0), false},
+		{"range for all cameras", "x", "back", at(20, 30), at(21, 30), true},
+	} {
+		if got := p.Covers(test.path, test.camera, test.start, test.end); (got != nil) != test.want {
+			t.Errorf("%s: got %v, want covered = %v", test.name, got, test.want)
+		}
+	}
+
+	for _, e := range []*Protection{
+		{},
+		{From: at(10, 0)},
+		{From: at(11, 0), To: at(10, 0)},
+	} {
+		if _, err := p.Add(e); err == nil {
+			t.Errorf("invalid protection %+v was added", e)
+		}
+	}
+}
+
+func TestRetentionProtected(t *testing.T) {
+	d := testDir(t, time.UTC)
+	d.quota = &Quota{Bytes: 1}
+
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	byPath := d.record(t, "front", start, start.Add(time.Hour), 100)
+	// protected by a range covering only its last 10 minutes
+	byRange := d.record(t, "front", start.Add(time.Hour), start.Add(2*time.Hour), 100)
+	unprotected := d.record(t, "front", start.Add(2*time.Hour), start.Add(3*time.Hour), 100)
+	// the range protects the front camera only
+	otherCamera := d.record(t, "back", start.Add(time.Hour), start.Add(2*time.Hour), 100)
+
+	d.indexed(t)
+
+	p, err := OpenProtections(d.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Add(&Protection{Path: byPath}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Add(&Protection{Camera: "front", From: start.Add(110 * time.Minute), To: start.Add(2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// unprotected recordings older than the rotation period are removed, then
+	// the quota removes the rest except for the protected ones
+	for _, days := range []int{7, 60} {
+		report := d.retain(start.Add(30*24*time.Hour), days, true)
+
+		removed := map[string]bool{}
+		for _, item := range report.Removed {
+			removed[item.Path] = true
+		}
+
+		if removed[byPath] || removed[byRange] {
+			t.Errorf("rotation of %d days: protected recordings removed: %v", days, removedPaths(report))
+		}
+
+		if !removed[unprotected] || !removed[otherCamera] {
+			t.Errorf("rotation of %d days: unprotected recordings kept: %v", days, removedPaths(report))
+		}
+	}
+
+	d.retain(start.Add(30*24*time.Hour), 7, false)
+
+	for path, want := range map[string]bool{byPath: true, byRange: true, unprotected: false, otherCamera: false} {
+		if exists(path) != want {
+			t.Errorf("%s: exists = %v, want %v", path, exists(path), want)
+		}
+	}
+}
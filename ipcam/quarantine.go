@@ -0,0 +1,64 @@
+package ipcam
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+type FailureReport struct {
+	Output    string    `json:"output"`
+	Video     string    `json:"video"`
+	Audio     string    `json:"audio"`
+	VideoRate string    `json:"videoRate"`
+	Attempts  int       `json:"attempts"`
+	Profiles  []string  `json:"profiles"`
+	Errors    []string  `json:"errors"`
+	Time      time.Time `json:"time"`
+}
+
+func (s *SplitStream) quarantine(videoRate string, errs []error) error {
+	name := strings.TrimSuffix(filepath.Base(s.outPath), filepath.Ext(s.outPath))
+	target := filepath.Join(s.failDir, name)
+
+	logCh <- log.NewMessage().Level(log.LLWarn).Sub("quarantine()").Message("moving cached A/V files to failed directory").Metadata(log.Field{
+		"path": target,
+		"cache": map[string]interface{}{
+			"video": s.video.outPath,
+			"audio": s.audio.outPath,
+		},
+	}).Build()
+
+	s.failed = target
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+
+	report := &FailureReport{
+		Output:    s.outPath,
+		Video:     filepath.Join(target, filepath.Base(s.video.outPath)),
+		Audio:     filepath.Join(target, filepath.Base(s.audio.outPath)),
+		VideoRate: videoRate,
+		Attempts:  s.attempts,
+		Profiles:  s.profiles,
+		Time:      time.Now(),
+	}
+
+	for _, err := range errs {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	if err := moveFile(s.video.outPath, report.Video); err != nil {
+		return err
+	}
+
+	if err := moveFile(s.audio.outPath, report.Audio); err != nil {
+		return err
+	}
+
+	return writeJSON(filepath.Join(target, "report.json"), report)
+}
@@ -0,0 +1,100 @@
+package ipcam
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testSplitStream(t *testing.T) *SplitStream {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	s := &SplitStream{
+		audio:   &Stream{name: "audio", outPath: filepath.Join(dir, "a.mp4")},
+		video:   &Stream{name: "video", outPath: filepath.Join(dir, "v.mp4")},
+		outPath: filepath.Join(dir, "out", "2022-05-30-10-00-00.mp4"),
+		failDir: filepath.Join(dir, "failed"),
+		retries: 3,
+	}
+
+	for _, path := range []string{s.audio.outPath, s.video.outPath} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+func readReport(t *testing.T, dir string) *FailureReport {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(dir, "report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := &FailureReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		t.Fatal(err)
+	}
+
+	return report
+}
+
+func TestQuarantineProfiles(t *testing.T) {
+	s := testSplitStream(t)
+
+	// the profiles actually used, e.g. after entering degraded mode mid-retries
+	s.attempts = 3
+	s.profiles = []string{DefaultProfile.Name, LowDiskProfile.Name, LowDiskProfile.Name}
+
+	errs := []error{errors.New("one"), errors.New("two"), errors.New("three")}
+
+	if err := s.quarantine("25", errs); err != nil {
+		t.Fatal(err)
+	}
+
+	report := readReport(t, s.failed)
+
+	if report.Attempts != 3 || !reflect.DeepEqual(report.Profiles, s.profiles) {
+		t.Errorf("got %d attempts with profiles %v, want 3 with %v", report.Attempts, report.Profiles, s.profiles)
+	}
+	if !reflect.DeepEqual(report.Errors, []string{"one", "two", "three"}) {
+		t.Errorf("got errors %v", report.Errors)
+	}
+	if exists(s.video.outPath) || !exists(report.Video) || !exists(report.Audio) {
+		t.Error("cached files weren't moved to the failed directory")
+	}
+}
+
+func TestFlagRemerge(t *testing.T) {
+	s := testSplitStream(t)
+
+	s.remerge = true
+	s.attempts = 1
+	s.profiles = []string{DefaultProfile.Name}
+	s.probe = &ProbeResult{Mismatch: []string{"no audio stream found"}}
+
+	s.flagRemerge("25")
+
+	info := s.Info("25", ResultMerged)
+
+	if !info.Remerge || info.Quarantine == "" || info.Result != ResultMerged {
+		t.Errorf("recording wasn't flagged for a re-merge: %+v", info)
+	}
+
+	report := readReport(t, info.Quarantine)
+
+	if report.Attempts != 1 || !exists(report.Video) || !exists(report.Audio) {
+		t.Errorf("cached files weren't kept: %+v", report)
+	}
+	if len(report.Errors) != 1 || report.Errors[0] != "merged file failed verification: no audio stream found" {
+		t.Errorf("got errors %v", report.Errors)
+	}
+}
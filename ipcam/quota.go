@@ -0,0 +1,87 @@
+package ipcam
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Quota is a storage budget, either as an absolute number of bytes or as a
+// percentage of the filesystem's size
+type Quota struct {
+	Bytes   int64
+	Percent float64
+}
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseQuota reads a quota such as "500G", "1.5T", "1073741824" or "80%". An
+// empty string returns a nil Quota
+func ParseQuota(value string) (*Quota, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return nil, nil
+	}
+
+	if strings.HasSuffix(value, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || !(pct > 0) || pct > 100 {
+			return nil, fmt.Errorf("invalid quota percentage %q", value)
+		}
+		return &Quota{Percent: pct}, nil
+	}
+
+	num := strings.TrimRight(strings.TrimSuffix(value, "B"), "KMGT")
+	unit := strings.TrimSuffix(strings.TrimPrefix(value, num), "B")
+
+	mult, ok := sizeUnits[unit]
+	if !ok {
+		return nil, fmt.Errorf("invalid quota unit in %q", value)
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || !(n > 0) || math.IsInf(n, 0) {
+		return nil, fmt.Errorf("invalid quota size %q", value)
+	}
+
+	size := n * float64(mult)
+	if size < 1 || size > math.MaxInt64 {
+		return nil, fmt.Errorf("invalid quota size %q", value)
+	}
+
+	return &Quota{Bytes: int64(size)}, nil
+}
+
+// Limit returns the quota in bytes for the filesystem holding path
+func (q *Quota) Limit(path string) (int64, error) {
+	if q.Percent == 0 {
+		return q.Bytes, nil
+	}
+
+	usage, err := usageOf(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(float64(usage.Total) * q.Percent / 100), nil
+}
+
+func (q *Quota) String() string {
+	if q == nil {
+		return ""
+	}
+
+	if q.Percent != 0 {
+		return strconv.FormatFloat(q.Percent, 'f', -1, 64) + "%"
+	}
+
+	return strconv.FormatInt(q.Bytes, 10)
+}
@@ -0,0 +1,66 @@
+package ipcam
+
+import "testing"
+
+func TestParseQuota(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		ok    bool
+		want  *Quota
+	}{
+		{"", true, nil},
+		{"  ", true, nil},
+		{"1073741824", true, &Quota{Bytes: 1 << 30}},
+		{"100B", true, &Quota{Bytes: 100}},
+		{"512K", true, &Quota{Bytes: 512 << 10}},
+		{"500G", true, &Quota{Bytes: 500 << 30}},
+		{"500gb", true, &Quota{Bytes: 500 << 30}},
+		{"1.5T", true, &Quota{Bytes: 3 << 39}},
+		{"80%", true, &Quota{Percent: 80}},
+		{"12.5%", true, &Quota{Percent: 12.5}},
+		{"100%", true, &Quota{Percent: 100}},
+		{"0%", false, nil},
+		{"101%", false, nil},
+		{"NaN%", false, nil},
+		{"0", false, nil},
+		{"-5G", false, nil},
+		{"0.5", false, nil},
+		{"NaN", false, nil},
+		{"Inf", false, nil},
+		{"9999999T", false, nil},
+		{"5GG", false, nil},
+		{"5P", false, nil},
+		{"G", false, nil},
+		{"lots", false, nil},
+	} {
+		got, err := ParseQuota(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseQuota(%q): got error %v, want ok = %v", test.value, err, test.ok)
+			continue
+		}
+
+		switch {
+		case test.want == nil && got != nil:
+			t.Errorf("ParseQuota(%q): got %+v, want nil", test.value, got)
+		case test.want != nil && (got == nil || *got != *test.want):
+			t.Errorf("ParseQuota(%q): got %+v, want %+v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestQuotaString(t *testing.T) {
+	for _, value := range []string{"80%", "12.5%", "1073741824"} {
+		q, err := ParseQuota(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := q.String(); got != value {
+			t.Errorf("String(): got %q, want %q", got, value)
+		}
+	}
+
+	if got := (*Quota)(nil).String(); got != "" {
+		t.Errorf("nil String(): got %q, want empty", got)
+	}
+}
@@ -0,0 +1,415 @@
+package ipcam
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+// retentionMu serializes the changes to the output directory made by retention:
+// rotation, which starts on every segment and from the API, emergency removals
+// and the retention tiers' commits
+var retentionMu sync.Mutex
+
+type dir struct {
+	root        string
+	layout      *Layout
+	index       *Index
+	camera      string
+	quota       *Quota
+	cameraQuota *Quota
+	tiers       []*RetentionTier
+	events      *EventBus
+}
+
+// recording groups a recording's files (the video and its sidecar) found in the
+// output directory
+type recording struct {
+	path      string
+	files     []string
+	start     time.Time
+	end       time.Time
+	camera    string
+	size      int64
+	protected *Protection
+}
+
+type removal struct {
+	rec    *recording
+	reason string
+}
+
+// recordings walks the output directory for recordings matching the dir's
+// layout, sorted by start time
+func (d *dir) recordings() ([]*recording, []error) {
+	var errs []error
+
+	byBase := map[string]*recording{}
+
+	err := filepath.WalkDir(d.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("recordings()").Message("failed to read output directory").Metadata(log.Field{"target": path, "error": err.Error()}).Build()
+
+			errs = append(errs, err)
+			return nil
+		}
+
+		if entry.IsDir() {
+			if path != d.root && reserved[entry.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if path == filepath.Join(d.root, indexFile) || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		t, ok := d.layout.Parse(d.root, path)
+		if !ok {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+
+		base := strings.TrimSuffix(path, filepath.Ext(path))
+
+		rec, ok := byBase[base]
+		if !ok {
+			rec = &recording{
+				start:  t,
+				camera: d.layout.Camera(d.root, path),
+			}
+			byBase[base] = rec
+		}
+
+		rec.files = append(rec.files, path)
+		rec.size += info.Size()
+
+		if info.ModTime().After(rec.end) {
+			rec.end = info.ModTime()
+		}
+
+		if filepath.Ext(path) != sidecarExt {
+			rec.path = path
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	indexed := map[string]*IndexEntry{}
+	if d.index != nil {
+		for _, e := range d.index.Query("", time.Time{}, time.Time{}) {
+			indexed[e.Path] = e
+		}
+	}
+
+	// if the protections can't be read, nothing is safe to remove
+	protections, err := OpenProtections(d.root)
+	if err != nil {
+		logCh <- log.NewMessage().Level(log.LLError).Sub("recordings()").Message("failed to read protected recordings -- skipping retention").Metadata(log.Field{"error": err.Error()}).Build()
+
+		return nil, append(errs, err)
+	}
+
+	recs := make([]*recording, 0, len(byBase))
+	for base, rec := range byBase {
+		if rec.path == "" {
+			rec.path = base + sidecarExt
+		}
+		if e, ok := indexed[rec.path]; ok {
+			if rec.camera == "" {
+				rec.camera = e.Camera
+			}
+			rec.end = e.End
+		}
+
+		rec.protected = protections.Covers(rec.path, rec.camera, rec.start, rec.end)
+
+		recs = append(recs, rec)
+	}
+
+	sort.Slice(recs, func(a, b int) bool {
+		return recs[a].start.Before(recs[b].start)
+	})
+
+	return recs, errs
+}
+
+// listOlder returns the recordings from a date older than the number of days
+// before from
+func (d *dir) listOlder(recs []*recording, from time.Time, days int) []*recording {
+	var older []*recording
+
+	day := time.Duration(24 * time.Hour)
+
+	tresh := from.Add(time.Duration(-days) * day)
+
+	for _, rec := range recs {
+		t := rec.start.In(from.Location())
+
+		// compare the recording's date, as rotation works on whole days
+		if date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()); date.Before(tresh) {
+			older = append(older, rec)
+		}
+	}
+
+	return older
+}
+
+// overQuota returns the oldest recordings to remove so that the size of recs fits
+// within the quota
+func (d *dir) overQuota(recs []*recording, quota *Quota) ([]*recording, error) {
+	limit, err := quota.Limit(d.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, rec := range recs {
+		total += rec.size
+	}
+
+	var over []*recording
+
+	for _, rec := range recs {
+		if total <= limit {
+			break
+		}
+
+		// protected recordings count towards the quota but are never removed
+		if rec.protected != nil {
+			continue
+		}
+
+		over = append(over, rec)
+		total -= rec.size
+	}
+
+	return over, nil
+}
+
+// plan lists the recordings that retention would remove, and why
+func (d *dir) plan(from time.Time, days int) ([]*removal, []error) {
+	recs, errs := d.recordings()
+
+	var removals []*removal
+	removed := map[*recording]bool{}
+
+	for _, rec := range d.listOlder(recs, from, days) {
+		if rec.protected != nil {
+			continue
+		}
+
+		removals = append(removals, &removal{rec: rec, reason: "older than the rotation period"})
+		removed[rec] = true
+	}
+
+	keep := func(camera string) []*recording {
+		var kept []*recording
+		for _, rec := range recs {
+			if !removed[rec] && (camera == "" || rec.camera == camera) {
+				kept = append(kept, rec)
+			}
+		}
+		return kept
+	}
+
+	quotas := []struct {
+		quota  *Quota
+		camera string
+		reason string
+	}{
+		{d.cameraQuota, d.camera, "camera storage quota exceeded"},
+		{d.quota, "", "storage quota exceeded"},
+	}
+
+	for _, q := range quotas {
+		if q.quota == nil || (q.quota == d.cameraQuota && d.camera == "") {
+			continue
+		}
+
+		over, err := d.overQuota(keep(q.camera), q.quota)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, rec := range over {
+			removals = append(removals, &removal{rec: rec, reason: q.reason})
+			removed[rec] = true
+		}
+	}
+
+	return removals, errs
+}
+
+func (d *dir) remove(r *removal) error {
+	for _, file := range r.rec.files {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	if d.index != nil {
+		if err := d.index.Remove(r.rec.path); err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("remove()").Message("failed to update recording index").Metadata(log.Field{"target": r.rec.path, "error": err.Error()}).Build()
+		}
+	}
+
+	removeEmptyDirs(d.root, filepath.Dir(r.rec.path))
+
+	retentionDeletes.Inc(r.reason)
+	retentionFreed.Add("", float64(r.rec.size))
+
+	return nil
+}
+
+type RetentionReport struct {
+	Time    time.Time        `json:"time"`
+	DryRun  bool             `json:"dryRun"`
+	Removed []*RetentionItem `json:"removed"`
+	Freed   int64            `json:"freed"`
+	Errors  []string         `json:"errors,omitempty"`
+}
+
+type RetentionItem struct {
+	Path   string    `json:"path"`
+	Camera string    `json:"camera,omitempty"`
+	Start  time.Time `json:"start"`
+	Files  []string  `json:"files"`
+	Size   int64     `json:"size"`
+	Reason string    `json:"reason"`
+}
+
+// retain applies (or with dryRun, only plans) the rotation period and quotas,
+// returning a report of the removed recordings
+func (d *dir) retain(from time.Time, days int, dryRun bool) *RetentionReport {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	removals, errs := d.plan(from, days)
+
+	report := &RetentionReport{
+		Time:    from,
+		DryRun:  dryRun,
+		Removed: []*RetentionItem{},
+	}
+
+	for _, err := range errs {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("retain()").Message("failed to list stream files").Metadata(log.Field{"error": err.Error()}).Build()
+
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	for _, r := range removals {
+		if !dryRun {
+			if err := d.remove(r); err != nil {
+				logCh <- log.NewMessage().Level(log.LLWarn).Sub("retain()").Message("failed to remove old stream files").Metadata(log.Field{"target": r.rec.path, "error": err.Error()}).Build()
+
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+
+			logCh <- log.NewMessage().Sub("retain()").Message("removed recording").Metadata(log.Field{
+				"target": r.rec.path,
+				"camera": r.rec.camera,
+				"size":   r.rec.size,
+				"reason": r.reason,
+			}).Build()
+		}
+
+		report.Removed = append(report.Removed, &RetentionItem{
+			Path:   r.rec.path,
+			Camera: r.rec.camera,
+			Start:  r.rec.start,
+			Files:  r.rec.files,
+			Size:   r.rec.size,
+			Reason: r.reason,
+		})
+		report.Freed += r.rec.size
+	}
+
+	return report
+}
+
+func (d *dir) rotate(from time.Time, days int) *RetentionReport {
+	report := d.retain(from, days, false)
+
+	logCh <- log.NewMessage().Sub("rotate()").Message("retention run completed").Metadata(log.Field{
+		"removed": report.Removed,
+		"count":   len(report.Removed),
+		"freed":   report.Freed,
+		"errors":  len(report.Errors),
+	}).Build()
+
+	d.events.publish(&Event{Type: EventRotated, Retention: report})
+
+	return report
+}
+
+// free removes the oldest recordings, from any camera, until need bytes are
+// freed. It stops early if a removal doesn't increase the free space in path's
+// filesystem (e.g. the files are still held open elsewhere), rather than
+// removing the whole archive for nothing
+func (d *dir) free(need int64, path string) int64 {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	recs, errs := d.recordings()
+
+	for _, err := range errs {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("free()").Message("failed to list stream files").Metadata(log.Field{"error": err.Error()}).Build()
+	}
+
+	var freed int64
+
+	for _, rec := range recs {
+		if freed >= need {
+			break
+		}
+
+		if rec.protected != nil {
+			continue
+		}
+
+		before, err := usageOf(path)
+		if err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("free()").Message("unable to read disk usage").Metadata(log.Field{"path": path, "error": err.Error()}).Build()
+			break
+		}
+
+		if err := d.remove(&removal{rec: rec, reason: "low disk space"}); err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("free()").Message("failed to remove old stream files").Metadata(log.Field{"target": rec.path, "error": err.Error()}).Build()
+			continue
+		}
+
+		freed += rec.size
+
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("free()").Message("removed recording").Metadata(log.Field{
+			"target": rec.path,
+			"camera": rec.camera,
+			"size":   rec.size,
+			"reason": "low disk space",
+		}).Build()
+
+		if after, err := usageOf(path); err != nil || after.Free <= before.Free {
+			logCh <- log.NewMessage().Level(log.LLError).Sub("free()").Message("removing recordings doesn't free disk space -- stopping").Metadata(log.Field{"path": path, "target": rec.path}).Build()
+			break
+		}
+	}
+
+	return freed
+}
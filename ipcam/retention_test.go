@@ -0,0 +1,303 @@
+package ipcam
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testDir creates a dir on an empty output directory, with the layout
+// "{camera}/{date}/{datetime}" in loc
+func testDir(t *testing.T, loc *time.Location) *dir {
+	t.Helper()
+
+	root := t.TempDir()
+
+	layout, err := ParseLayout("{camera}/{date}/{datetime}", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &dir{root: root, layout: layout, camera: "front"}
+}
+
+// record writes a recording of size bytes for camera, starting at start, with a
+// sidecar ending at end (if not zero), and returns its path
+func (d *dir) record(t *testing.T, camera string, start, end time.Time, size int) string {
+	t.Helper()
+
+	path := d.layout.Path(d.root, camera, start, ".mp4")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if !end.IsZero() {
+		info := &SegmentInfo{Camera: camera, Output: path, Start: start, End: end, Result: ResultMerged}
+		if err := writeJSON(sidecarPath(path), info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+// indexed rebuilds the dir's index from its files
+func (d *dir) indexed(t *testing.T) {
+	t.Helper()
+
+	idx, err := RebuildIndex(d.root, d.layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.index = idx
+}
+
+func removedPaths(report *RetentionReport) []string {
+	var paths []string
+	for _, item := range report.Removed {
+		paths = append(paths, item.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRetentionAge(t *testing.T) {
+	lisbon, err := time.LoadLocation("Europe/Lisbon")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	d := testDir(t, lisbon)
+
+	// 23:30 on the 23rd in Lisbon, and 00:30 on the 24th, although both are on
+	// the 23rd in UTC
+	old := d.record(t, "front", time.Date(2022, 5, 23, 22, 30, 0, 0, time.UTC), time.Time{}, 10)
+	kept := d.record(t, "front", time.Date(2022, 5, 23, 23, 30, 0, 0, time.UTC), time.Time{}, 10)
+	recent := d.record(t, "back", time.Date(2022, 5, 29, 10, 0, 0, 0, time.UTC), time.Time{}, 10)
+
+	report := d.retain(time.Date(2022, 5, 30, 12, 0, 0, 0, lisbon), 7, false)
+
+	if paths := removedPaths(report); len(paths) != 1 || paths[0] != old {
+		t.Errorf("removed %v, want only %s", paths, old)
+	}
+
+	if exists(old) || !exists(kept) || !exists(recent) {
+		t.Errorf("unexpected files left: old %v, kept %v, recent %v", exists(old), exists(kept), exists(recent))
+	}
+
+	// in UTC, both recordings from the 23rd are too old
+	d = testDir(t, time.UTC)
+	d.record(t, "front", time.Date(2022, 5, 23, 22, 30, 0, 0, time.UTC), time.Time{}, 10)
+	d.record(t, "front", time.Date(2022, 5, 23, 23, 30, 0, 0, time.UTC), time.Time{}, 10)
+
+	if report := d.retain(time.Date(2022, 5, 30, 12, 0, 0, 0, time.UTC), 7, false); len(report.Removed) != 2 {
+		t.Errorf("UTC: removed %v, want both recordings", removedPaths(report))
+	}
+}
+
+func TestRetentionCameraQuota(t *testing.T) {
+	d := testDir(t, time.UTC)
+	d.cameraQuota = &Quota{Bytes: 150}
+
+	start := time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC)
+
+	var front, back []string
+	for n := 0; n < 3; n++ {
+		at := start.Add(time.Duration(n) * time.Hour)
+		front = append(front, d.record(t, "front", at, time.Time{}, 100))
+		// the other camera's recordings are older, but aren't the camera's to remove
+		back = append(back, d.record(t, "back", at.Add(-24*time.Hour), time.Time{}, 100))
+	}
+
+	report := d.retain(start.Add(24*time.Hour), 30, false)
+
+	if paths := removedPaths(report); len(paths) != 2 || paths[0] != front[0] || paths[1] != front[1] {
+		t.Errorf("removed %v, want the two oldest of %v", paths, front)
+	}
+
+	for _, path := range append(back, front[2]) {
+		if !exists(path) {
+			t.Errorf("%s was removed", path)
+		}
+	}
+
+	if report.Freed != 200 {
+		t.Errorf("freed %d bytes, want 200", report.Freed)
+	}
+}
+
+func TestRetentionGlobalQuota(t *testing.T) {
+	d := testDir(t, time.UTC)
+	d.quota = &Quota{Bytes: 250}
+
+	start := time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC)
+
+	// oldest first: back, front, back, front
+	paths := []string{
+		d.record(t, "back", start, time.Time{}, 100),
+		d.record(t, "front", start.Add(time.Hour), time.Time{}, 100),
+		d.record(t, "back", start.Add(2*time.Hour), time.Time{}, 100),
+		d.record(t, "front", start.Add(3*time.Hour), time.Time{}, 100),
+	}
+
+	d.indexed(t)
+
+	report := d.retain(start.Add(24*time.Hour), 30, false)
+
+	want := []string{paths[0], paths[1]}
+	sort.Strings(want)
+
+	if got := removedPaths(report); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("removed %v, want %v", got, want)
+	}
+
+	for n, path := range paths {
+		if exists(path) != (n >= 2) {
+			t.Errorf("%s: exists = %v", path, exists(path))
+		}
+	}
+
+	// the index only lists the recordings left
+	entries := d.index.Query("", time.Time{}, time.Time{})
+	if len(entries) != 2 || entries[0].Path != paths[2] || entries[1].Path != paths[3] {
+		t.Errorf("unexpected index entries after retention: %v", entries)
+	}
+
+	saved, err := OpenIndex(d.root, d.layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Entries) != 2 {
+		t.Errorf("saved index has %d entries, want 2", len(saved.Entries))
+	}
+}
+
+// snapshot reads every file under root, with its contents and modification time
+func snapshot(t *testing.T, root string) map[string]string {
+	t.Helper()
+
+	files := map[string]string{}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		files[path] = info.ModTime().String() + " " + string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestRetentionDryRun(t *testing.T) {
+	d := testDir(t, time.UTC)
+
+	now := time.Now().UTC()
+
+	old := d.record(t, "front", now.Add(-30*24*time.Hour), now.Add(-30*24*time.Hour+time.Hour), 100)
+	d.record(t, "front", now.Add(-2*time.Hour), now.Add(-time.Hour), 100)
+	d.record(t, "back", now.Add(-3*time.Hour), now.Add(-2*time.Hour), 100)
+	d.indexed(t)
+
+	protections, err := OpenProtections(d.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protections.Add(&Protection{Camera: "back", From: now.Add(-4 * time.Hour), To: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := snapshot(t, d.root)
+
+	s := testService("front")
+	req := &StreamRequest{
+		Camera:   "front",
+		OutDir:   d.root,
+		Rotate:   7,
+		Timezone: "UTC",
+		Layout:   "{camera}/{date}/{datetime}",
+		Quota:    "150",
+	}
+
+	if err := s.ConfigureRetention(req, true); err != nil {
+		t.Fatal(err)
+	}
+
+	report := s.Retention(true)
+
+	if !report.DryRun || len(report.Removed) != 2 || report.Removed[0].Path != old {
+		t.Errorf("unexpected dry run report: %v", removedPaths(report))
+	}
+
+	after := snapshot(t, d.root)
+
+	if len(after) != len(before) {
+		t.Errorf("dry run changed the files: %d before, %d after", len(before), len(after))
+	}
+
+	for path, file := range before {
+		if after[path] != file {
+			t.Errorf("dry run changed %s", path)
+		}
+	}
+}
+
+func TestRetentionConcurrent(t *testing.T) {
+	d := testDir(t, time.UTC)
+	d.quota = &Quota{Bytes: 1}
+
+	start := time.Date(2022, 5, 30, 0, 0, 0, 0, time.UTC)
+
+	for n := 0; n < 20; n++ {
+		at := start.Add(time.Duration(n) * time.Hour)
+		d.record(t, "front", at, at.Add(time.Hour), 100)
+	}
+	d.indexed(t)
+
+	// rotation starts on every segment, and from the API: concurrent runs
+	// must not race to remove the same recordings
+	reports := make(chan *RetentionReport, 4)
+	for n := 0; n < cap(reports); n++ {
+		go func() {
+			reports <- d.retain(start.Add(24*time.Hour), 7, false)
+		}()
+	}
+
+	var removed int
+	for n := 0; n < cap(reports); n++ {
+		report := <-reports
+		if len(report.Errors) > 0 {
+			t.Errorf("unexpected errors: %v", report.Errors)
+		}
+		removed += len(report.Removed)
+	}
+
+	// each recording is removed once, by whichever run planned it first
+	if removed != 20 {
+		t.Errorf("removed %d recordings, want 20", removed)
+	}
+
+	if entries := d.index.Query("", time.Time{}, time.Time{}); len(entries) != 0 {
+		t.Errorf("got %d index entries, want none", len(entries))
+	}
+}
@@ -0,0 +1,72 @@
+package ipcam
+
+import "time"
+
+const (
+	folderLayout     = "2006-01-02"
+	fileLayout       = "2006-01-02-15-04-05Z0700"
+	legacyFileLayout = "2006-01-02-15-04-05"
+)
+
+// LoadLocation returns the time zone for name, which is either "Local" (or
+// empty) for the system's time zone, "UTC", or an IANA time zone name
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+
+	return time.LoadLocation(name)
+}
+
+// ParseFileTime parses a recording's file name (without extension) into its
+// start time. Names without a UTC offset are read in loc
+func ParseFileTime(name string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(fileLayout, name); err == nil {
+		return t.In(loc), nil
+	}
+
+	return time.ParseInLocation(legacyFileLayout, name, loc)
+}
+
+// segmentEnd returns the deadline for a segment starting at start. With an align
+// interval, the deadline is snapped back to the last wall-clock boundary (counted
+// from midnight) at or before start+length, so that the first segment after a
+// restart is shorter and the following ones line up with the clock. A segment
+// never runs past its length: when the boundary is right after start, the first
+// segment is only a few seconds long; if the align interval is longer than the
+// segment and there's no boundary within it, the segment ends at its full length.
+//
+// Segments never cross midnight, so that each dated folder only holds footage
+// from that date
+func segmentEnd(start time.Time, length, align time.Duration) time.Time {
+	end := start.Add(length)
+
+	if align > 0 {
+		if b := boundary(end, align, 0); b.After(start) {
+			end = b
+		}
+	}
+
+	if midnight := nextMidnight(start); end.After(midnight) {
+		return midnight
+	}
+
+	return end
+}
+
+func nextMidnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+}
+
+// boundary returns the wall-clock boundary of the align interval at or before t,
+// moved forward by n intervals
+func boundary(t time.Time, align time.Duration, n int) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	elapsed := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+
+	k := int(elapsed/align) + n
+
+	// use wall-clock arithmetic so that DST changes don't shift the boundaries
+	return time.Date(midnight.Year(), midnight.Month(), midnight.Day(), 0, 0, 0, int(time.Duration(k)*align), t.Location())
+}
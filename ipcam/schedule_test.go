@@ -0,0 +1,128 @@
+package ipcam
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSegmentEnd(t *testing.T) {
+	at := func(h, m, s int) time.Time {
+		return time.Date(2022, 5, 30, h, m, s, 0, time.UTC)
+	}
+
+	for _, test := range []struct {
+		name   string
+		start  time.Time
+		length time.Duration
+		align  time.Duration
+		want   time.Time
+	}{
+		{"unaligned", at(9, 13, 47), time.Hour, 0, at(10, 13, 47)},
+		{"first segment after a restart", at(9, 13, 47), time.Hour, time.Hour, at(10, 0, 0)},
+		{"on a boundary", at(10, 0, 0), time.Hour, time.Hour, at(11, 0, 0)},
+		{"quarter hours", at(9, 13, 47), time.Hour, 15 * time.Minute, at(10, 0, 0)},
+		{"shorter segments", at(9, 13, 47), 15 * time.Minute, 15 * time.Minute, at(9, 15, 0)},
+		{"boundary right after the start", at(9, 59, 30), time.Hour, time.Hour, at(10, 0, 0)},
+		{"boundary a minute after the start", at(9, 59, 0), time.Hour, time.Hour, at(10, 0, 0)},
+		{"align longer than the segment", at(9, 13, 47), 10 * time.Minute, time.Hour, at(9, 23, 47)},
+		{"align longer, boundary within the segment", at(9, 55, 0), 10 * time.Minute, time.Hour, at(10, 0, 0)},
+		{"align longer, boundary right after the start", at(9, 59, 30), 10 * time.Minute, time.Hour, at(10, 0, 0)},
+		{"align longer, starting on a boundary", at(10, 0, 0), 10 * time.Minute, time.Hour, at(10, 10, 0)},
+	} {
+		if got := segmentEnd(test.start, test.length, test.align); !got.Equal(test.want) {
+			t.Errorf("%s: segmentEnd(%s, %s, %s): got %s, want %s", test.name,
+				test.start.Format("15:04:05"), test.length, test.align, got.Format("15:04:05"), test.want.Format("15:04:05"))
+		}
+	}
+}
+
+func TestSegmentEndMidnight(t *testing.T) {
+	lisbon, err := time.LoadLocation("Europe/Lisbon")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		start  time.Time
+		length time.Duration
+		align  time.Duration
+		want   time.Time
+	}{
+		{"cut at midnight", time.Date(2022, 5, 30, 23, 30, 0, 0, time.UTC), time.Hour, 0, time.Date(2022, 5, 31, 0, 0, 0, 0, time.UTC)},
+		{"aligned, cut at midnight", time.Date(2022, 5, 30, 23, 30, 0, 0, time.UTC), 2 * time.Hour, 2 * time.Hour, time.Date(2022, 5, 31, 0, 0, 0, 0, time.UTC)},
+		{"midnight in the time zone", time.Date(2022, 5, 30, 23, 30, 0, 0, lisbon), time.Hour, 0, time.Date(2022, 5, 31, 0, 0, 0, 0, lisbon)},
+		{"end of month", time.Date(2022, 12, 31, 23, 45, 0, 0, time.UTC), time.Hour, 0, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// clocks go forward at 01:00 on 2022-03-27; boundaries stay on the wall clock
+		{"DST start", time.Date(2022, 3, 27, 0, 30, 0, 0, lisbon), time.Hour, time.Hour, time.Date(2022, 3, 27, 2, 0, 0, 0, lisbon)},
+		{"DST end", time.Date(2022, 10, 30, 3, 10, 0, 0, lisbon), time.Hour, time.Hour, time.Date(2022, 10, 30, 4, 0, 0, 0, lisbon)},
+	} {
+		if got := segmentEnd(test.start, test.length, test.align); !got.Equal(test.want) {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBoundary(t *testing.T) {
+	at := func(h, m, s int) time.Time {
+		return time.Date(2022, 5, 30, h, m, s, 0, time.UTC)
+	}
+
+	for _, test := range []struct {
+		t     time.Time
+		align time.Duration
+		n     int
+		want  time.Time
+	}{
+		{at(9, 13, 47), time.Hour, 0, at(9, 0, 0)},
+		{at(9, 13, 47), time.Hour, 1, at(10, 0, 0)},
+		{at(9, 0, 0), time.Hour, 0, at(9, 0, 0)},
+		{at(9, 13, 47), 15 * time.Minute, 0, at(9, 0, 0)},
+		{at(9, 15, 0), 15 * time.Minute, 1, at(9, 30, 0)},
+		{at(23, 50, 0), 15 * time.Minute, 1, time.Date(2022, 5, 31, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got := boundary(test.t, test.align, test.n); !got.Equal(test.want) {
+			t.Errorf("boundary(%s, %s, %d): got %s, want %s", test.t.Format("15:04:05"), test.align, test.n, got, test.want)
+		}
+	}
+}
+
+func TestParseFileTime(t *testing.T) {
+	lisbon, err := time.LoadLocation("Europe/Lisbon")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		loc  *time.Location
+		ok   bool
+		want time.Time
+	}{
+		{"2022-05-30-14-05-09Z", time.UTC, true, time.Date(2022, 5, 30, 14, 5, 9, 0, time.UTC)},
+		{"2022-05-30-14-05-09+0100", time.UTC, true, time.Date(2022, 5, 30, 13, 5, 9, 0, time.UTC)},
+		{"2022-05-30-14-05-09-0300", lisbon, true, time.Date(2022, 5, 30, 17, 5, 9, 0, time.UTC)},
+		// legacy names, without an offset, are read in the configured zone
+		{"2022-05-30-14-05-09", time.UTC, true, time.Date(2022, 5, 30, 14, 5, 9, 0, time.UTC)},
+		{"2022-05-30-14-05-09", lisbon, true, time.Date(2022, 5, 30, 13, 5, 9, 0, time.UTC)},
+		// the repeated hour when clocks go back is told apart by the offset
+		{"2022-10-30-01-30-00+0100", lisbon, true, time.Date(2022, 10, 30, 0, 30, 0, 0, time.UTC)},
+		{"2022-10-30-01-30-00Z", lisbon, true, time.Date(2022, 10, 30, 1, 30, 0, 0, time.UTC)},
+		{"2022-05-30", time.UTC, false, time.Time{}},
+		{"notes", time.UTC, false, time.Time{}},
+	} {
+		got, err := ParseFileTime(test.name, test.loc)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseFileTime(%q): got error %v, want ok = %v", test.name, err, test.ok)
+			continue
+		}
+
+		if !got.Equal(test.want) {
+			t.Errorf("ParseFileTime(%q): got %s, want %s", test.name, got, test.want)
+		}
+
+		if test.ok && got.Location() != test.loc {
+			t.Errorf("ParseFileTime(%q): got location %s, want %s", test.name, got.Location(), test.loc)
+		}
+	}
+}
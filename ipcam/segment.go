@@ -0,0 +1,215 @@
+package ipcam
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+const (
+	ResultMerged = "merged"
+	ResultFailed = "failed"
+)
+
+const (
+	sidecarExt    = ".json"
+	failedSidecar = "segment.json"
+)
+
+type SegmentInfo struct {
+	Camera     string       `json:"camera,omitempty"`
+	Output     string       `json:"output"`
+	Start      time.Time    `json:"start"`
+	End        time.Time    `json:"end"`
+	Timezone   string       `json:"timezone"`
+	Video      TrackInfo    `json:"video"`
+	Audio      TrackInfo    `json:"audio"`
+	VideoRate  string       `json:"videoRate"`
+	Profile    string       `json:"profile,omitempty"`
+	Tier       int          `json:"tier,omitempty"`
+	Result     string       `json:"result"`
+	Attempts   int          `json:"attempts"`
+	Remerge    bool         `json:"remerge,omitempty"`
+	Quarantine string       `json:"quarantine,omitempty"`
+	Errors     []string     `json:"errors,omitempty"`
+	Probe      *ProbeResult `json:"probe,omitempty"`
+}
+
+type TrackInfo struct {
+	URL    string   `json:"url"`
+	Bytes  int64    `json:"bytes"`
+	Frames int64    `json:"frames,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (s *Stream) info() TrackInfo {
+	return TrackInfo{
+		URL:    s.url,
+		Bytes:  s.Bytes(),
+		Frames: s.Frames(),
+		Errors: s.Errors(),
+	}
+}
+
+func (s *SplitStream) Info(videoRate, result string) *SegmentInfo {
+	info := &SegmentInfo{
+		Camera:     s.camera,
+		Output:     s.outPath,
+		Start:      s.start,
+		End:        s.end,
+		Timezone:   s.start.Location().String(),
+		Video:      s.video.info(),
+		Audio:      s.audio.info(),
+		VideoRate:  videoRate,
+		Result:     result,
+		Attempts:   s.attempts,
+		Remerge:    s.flagged,
+		Quarantine: s.failed,
+		Errors:     s.errs,
+		Probe:      s.probe,
+	}
+
+	if s.profile != nil {
+		info.Profile = s.profile.Name
+	}
+
+	return info
+}
+
+func (s *SplitStream) finalise(videoRate, result string) {
+	path := sidecarPath(s.outPath)
+	info := s.Info(videoRate, result)
+
+	// a failed merge has no output to sit next to: its metadata is kept with the
+	// quarantined files, if they could be moved
+	if result != ResultMerged {
+		path = ""
+		if s.failed != "" {
+			path = filepath.Join(s.failed, failedSidecar)
+		}
+	}
+
+	if path != "" {
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("finalise()").Message("writing segment metadata").Metadata(log.Field{"path": path, "result": result}).Build()
+
+		if err := writeJSON(path, info); err != nil {
+			logCh <- log.NewMessage().Level(log.LLError).Sub("finalise()").Message("failed to write segment metadata").Metadata(log.Field{"path": path, "error": err.Error()}).Build()
+		}
+	}
+
+	s.updateIndex(info)
+
+	event := EventMerged
+	if result != ResultMerged {
+		event = EventMergeFailed
+	}
+
+	s.events.publish(&Event{Type: event, Output: info.Output, Segment: info})
+}
+
+func sidecarPath(output string) string {
+	return strings.TrimSuffix(output, filepath.Ext(output)) + sidecarExt
+}
+
+func ReadSegmentInfo(path string) (*SegmentInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &SegmentInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// meter counts the bytes written to a stream's output, as well as the number of
+// JPEG frames (start-of-image markers) when the stream is a MJPEG video feed
+type meter struct {
+	w      io.Writer
+	s      *Stream
+	frames frameCounter
+}
+
+var soi = []byte{0xFF, 0xD8}
+
+func (m *meter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+
+	atomic.AddInt64(&m.s.bytes, int64(n))
+	trackBytes.Add(m.s.name, float64(n))
+
+	if m.s.frames && n > 0 {
+		atomic.AddInt64(&m.s.count, int64(m.frames.count(p[:n])))
+	}
+
+	return n, err
+}
+
+// frameCounter counts the JPEG images in a MJPEG stream as it is written,
+// matching the start-of-image and end-of-image markers in pairs like
+// frameSplitter, so that embedded images (e.g. EXIF thumbnails) aren't counted
+// as frames. Markers may be split across writes
+type frameCounter struct {
+	depth  int
+	marker bool
+	size   int
+}
+
+// count returns the number of images completed in p
+func (c *frameCounter) count(p []byte) int {
+	var frames int
+
+	for i := 0; i < len(p); {
+		if !c.marker {
+			idx := bytes.IndexByte(p[i:], 0xFF)
+			if idx < 0 {
+				break
+			}
+
+			c.marker = true
+			i += idx + 1
+			continue
+		}
+
+		c.marker = false
+
+		switch p[i] {
+		case soi[1]:
+			if c.depth == 0 {
+				c.size = 0
+			}
+			c.depth++
+		case eoi[1]:
+			if c.depth > 0 {
+				c.depth--
+
+				if c.depth == 0 {
+					frames++
+				}
+			}
+		case 0xFF:
+			c.marker = true
+		}
+
+		i++
+	}
+
+	// an image without an end, like in frameSplitter, is dropped
+	if c.depth > 0 {
+		if c.size += len(p); c.size > maxFrameSize {
+			c.depth = 0
+		}
+	}
+
+	return frames
+}
@@ -1,8 +1,10 @@
 package ipcam
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"time"
 
 	"github.com/zalgonoise/zlog/log"
@@ -14,20 +16,54 @@ var done chan struct{}
 type StreamService struct {
 	request *StreamRequest
 	// response *StreamResponse
-	Stream *SplitStream
-	Logger log.Logger
+	Stream  *SplitStream
+	Index   *Index
+	Logger  log.Logger
+	Events  *EventBus
+	loc     *time.Location
+	layout  *Layout
+	quota   *Quota
+	cquota  *Quota
+	minFree *Quota
+	guard   *diskGuard
+	control *control
+	live    *Broadcaster
+	hls     *HLSPipeline
+	hooks   *webhooks
+	mqtt    *mqttPublisher
 }
 
 type StreamRequest struct {
-	TimeLen   int    `json:"length,omitempty"`
-	VideoURL  string `json:"videoURL,omitempty"`
-	AudioURL  string `json:"audioURL,omitempty"`
-	TmpDir    string `json:"tmpDir,omitempty"`
-	OutDir    string `json:"outDir,omitempty"`
-	OutExt    string `json:"extension,omitempty"`
-	VideoRate string `json:"videoRate,omitempty"`
-	Rotate    int    `json:"rotate,omitempty"`
-	Logfile   string `json:"log,omitempty"`
+	Camera    string           `json:"camera,omitempty"`
+	TimeLen   int              `json:"length,omitempty"`
+	VideoURL  string           `json:"videoURL,omitempty"`
+	AudioURL  string           `json:"audioURL,omitempty"`
+	TmpDir    string           `json:"tmpDir,omitempty"`
+	OutDir    string           `json:"outDir,omitempty"`
+	OutExt    string           `json:"extension,omitempty"`
+	VideoRate string           `json:"videoRate,omitempty"`
+	Rotate    int              `json:"rotate,omitempty"`
+	Logfile   string           `json:"log,omitempty"`
+	Retries   int              `json:"mergeRetries,omitempty"`
+	Fallback  bool             `json:"mergeFallback,omitempty"`
+	Remerge   bool             `json:"remerge,omitempty"`
+	Align     int              `json:"align,omitempty"`
+	Timezone  string           `json:"timezone,omitempty"`
+	Layout    string           `json:"layout,omitempty"`
+	Quota     string           `json:"quota,omitempty"`
+	CamQuota  string           `json:"cameraQuota,omitempty"`
+	MinFree   string           `json:"minFree,omitempty"`
+	Tiers     []*RetentionTier `json:"tiers,omitempty"`
+	HTTPAddr  string           `json:"http,omitempty"`
+	TLSCert   string           `json:"tlsCert,omitempty"`
+	TLSKey    string           `json:"tlsKey,omitempty"`
+	Auth      *AuthConfig      `json:"auth,omitempty"`
+	Insecure  bool             `json:"insecure,omitempty"`
+	HLS       bool             `json:"hls,omitempty"`
+	HLSTime   int              `json:"hlsTime,omitempty"`
+	HLSWindow int              `json:"hlsWindow,omitempty"`
+	Webhooks  []*Webhook       `json:"webhooks,omitempty"`
+	MQTT      *MQTTConfig      `json:"mqtt,omitempty"`
 }
 
 var std = log.New(log.WithPrefix("ipcam-stream"), log.FormatText)
@@ -35,6 +71,8 @@ var std = log.New(log.WithPrefix("ipcam-stream"), log.FormatText)
 func New(loggers ...log.Logger) *StreamService {
 	service := &StreamService{
 		request: &StreamRequest{},
+		control: newControl(),
+		Events:  NewEventBus(),
 	}
 
 	// init multilogger
@@ -65,20 +103,73 @@ func New(loggers ...log.Logger) *StreamService {
 	return service
 }
 
-func (s *StreamService) Capture() {
+// Configure reads the service's configuration from the CLI flags (or config file)
+// and loads the output directory's layout, retention settings and index
+func (s *StreamService) Configure() {
 	s.request = s.Flags()
+	s.Events.camera = s.request.Camera
+
+	logCh <- log.NewMessage().Sub("Configure()").Message("new capture request").Metadata(s.request.logFields()).Build()
+
+	if err := s.loadRetention(); err != nil {
+		logCh <- log.NewMessage().Level(log.LLFatal).Sub("Configure()").Message("invalid output or retention settings").Metadata(log.Field{"error": err.Error()}).Build()
+	}
+
+	var err error
+
+	if s.minFree, err = ParseQuota(s.request.MinFree); err != nil {
+		logCh <- log.NewMessage().Level(log.LLFatal).Sub("Configure()").Message("failed to parse minimum free disk space").Metadata(log.Field{"minFree": s.request.MinFree, "error": err.Error()}).Build()
+	}
+
+	if err := s.request.Auth.Validate(); err != nil {
+		logCh <- log.NewMessage().Level(log.LLFatal).Sub("Configure()").Message("invalid HTTP API credentials").Metadata(log.Field{"error": err.Error()}).Build()
+	}
+
+	if s.request.HTTPAddr != "" && !s.request.Auth.Enabled() && !loopback(s.request.HTTPAddr) && !s.request.Insecure {
+		logCh <- log.NewMessage().Level(log.LLFatal).Sub("Configure()").Message("refusing to serve the HTTP API without credentials on a non-loopback address -- configure auth, or allow it with -insecure").Metadata(log.Field{"http": s.request.HTTPAddr}).Build()
+	}
+
+	if (s.request.TLSCert == "") != (s.request.TLSKey == "") {
+		logCh <- log.NewMessage().Level(log.LLFatal).Sub("Configure()").Message("TLS requires both a certificate and a key").Metadata(log.Field{"tlsCert": s.request.TLSCert, "tlsKey": s.request.TLSKey}).Build()
+	}
+
+	for _, hook := range s.request.Webhooks {
+		if err := hook.Validate(); err != nil {
+			logCh <- log.NewMessage().Level(log.LLFatal).Sub("Configure()").Message("invalid webhook").Metadata(log.Field{"error": err.Error()}).Build()
+		}
+	}
+
+	if err := s.request.MQTT.Validate(); err != nil {
+		logCh <- log.NewMessage().Level(log.LLFatal).Sub("Configure()").Message("invalid MQTT configuration").Metadata(log.Field{"error": err.Error()}).Build()
+	}
 
-	logCh <- log.NewMessage().Sub("Capture()").Message("new capture request").Metadata(log.Field{
-		"length":    s.request.TimeLen,
-		"videoURL":  s.request.VideoURL,
-		"audioURL":  s.request.AudioURL,
-		"tmpDir":    s.request.TmpDir,
-		"outDir":    s.request.OutDir,
-		"extension": s.request.OutExt,
-		"videoRate": s.request.VideoRate,
-		"rotate":    s.request.Rotate,
-		"log":       s.request.Logfile,
-	}).Build()
+	if s.request.HLS && s.request.HTTPAddr == "" {
+		logCh <- log.NewMessage().Level(log.LLFatal).Sub("Configure()").Message("live HLS output requires the HTTP API to be enabled").Build()
+	}
+
+	s.request.TmpDir = ExpandPath(s.request.TmpDir)
+	s.request.TLSCert = ExpandPath(s.request.TLSCert)
+	s.request.TLSKey = ExpandPath(s.request.TLSKey)
+	s.request.OutDir = ExpandPath(s.request.OutDir)
+
+	logCh <- log.NewMessage().Level(log.LLDebug).Sub("Configure()").Message("loading recording index").Metadata(log.Field{"path": s.request.OutDir}).Build()
+
+	s.Index, err = OpenIndex(s.request.OutDir, s.layout)
+	if err != nil || len(s.Index.Entries) == 0 {
+		if err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("Configure()").Message("failed to load recording index -- rebuilding it").Metadata(log.Field{"error": err.Error()}).Build()
+		}
+
+		s.Index, err = RebuildIndex(s.request.OutDir, s.layout)
+		if err != nil {
+			logCh <- log.NewMessage().Level(log.LLError).Sub("Configure()").Message("failed to rebuild recording index").Metadata(log.Field{"error": err.Error()}).Build()
+		}
+	}
+
+}
+
+func (s *StreamService) Capture() {
+	s.Configure()
 
 	// initialize service
 	//  - clear cache
@@ -100,6 +191,54 @@ func (s *StreamService) Capture() {
 		}
 	}
 
+	// merges interrupted by a crash leave their partial output behind
+	clearPartials(s.request.OutDir, s.layout)
+
+	if s.minFree != nil {
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("starting low disk space guard").Metadata(log.Field{"minFree": s.minFree.String()}).Build()
+
+		s.guard = &diskGuard{
+			paths:   []string{s.request.TmpDir, s.request.OutDir},
+			out:     s.request.OutDir,
+			minFree: s.minFree,
+			dir:     s.dir,
+			events:  s.Events,
+		}
+	}
+
+	if s.request.HTTPAddr != "" {
+		s.live = NewBroadcaster()
+
+		if s.request.HLS {
+			s.hls = NewHLSPipeline(filepath.Join(s.request.TmpDir, hlsDir), s.request.HLSTime, s.request.HLSWindow, s.live)
+
+			go s.hls.run()
+		}
+	}
+
+	// the publishers and the HTTP API read the service's state from their own
+	// goroutines, so they start once it's set up, and before anything publishes
+	// events
+	if len(s.request.Webhooks) > 0 {
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("starting webhooks").Metadata(log.Field{"webhooks": len(s.request.Webhooks)}).Build()
+
+		s.hooks = newWebhooks(s.request.Webhooks, s.request.OutDir)
+		s.hooks.start(s.Events)
+	}
+
+	if s.request.MQTT != nil {
+		s.mqtt = newMQTTPublisher(s.request.MQTT, s)
+		s.mqtt.start(s.Events)
+	}
+
+	if s.request.HTTPAddr != "" {
+		go s.Serve(s.request.HTTPAddr)
+	}
+
+	if s.guard != nil {
+		go s.guard.run()
+	}
+
 	logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("cache is ready; starting capture").Build()
 
 	s.newCaptureResponse(s.request)
@@ -110,64 +249,180 @@ func (s *StreamService) newCaptureResponse(req *StreamRequest) {
 	// handle signal: interrupt
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
-	go func(videoRate string) {
+	go func() {
 		<-c
 
-		logCh <- log.NewMessage().Sub("Capture()").Message("received signal interrupt -- merging cached files").Build()
+		logCh <- log.NewMessage().Sub("Capture()").Message("received signal interrupt -- cutting the segment and waiting for merges").Build()
 
-		s.Stream.Merge(videoRate)
+		// the capture loop ends the segment and merges it as usual; shutdown
+		// returns once the streams are closed and no merges are pending
+		s.control.shutdown()
+
+		s.mqtt.Close()
 
 		logCh <- log.NewMessage().Sub("Capture()").Message("merge completed -- exiting").Build()
 
 		os.Exit(0)
 
-	}(req.VideoRate)
+	}()
 
 	for {
-		now := time.Now()
+		s.control.wait()
+
+		stream := &SplitStream{
+			audio:    &Stream{name: "audio", events: s.Events},
+			video:    &Stream{name: "video", frames: true, relay: s.live, events: s.Events},
+			failDir:  filepath.Join(req.OutDir, "failed"),
+			retries:  req.Retries,
+			fallback: req.Fallback,
+			remerge:  req.Remerge,
+			camera:   req.Camera,
+			index:    s.Index,
+			loc:      s.loc,
+			guard:    s.guard,
+			events:   s.Events,
+		}
 
-		folderDate := now.Format("2006-01-02")
-		fileDate := now.Format("2006-01-02-15-04-05")
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("starting to capture audio/video HTTP stream").Build()
 
-		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("setting stream timestamp").Metadata(log.Field{"date": fileDate}).Build()
-		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("loading output directory").Metadata(log.Field{"path": req.OutDir}).Build()
+		s.Stream = stream
 
-		dir := &dir{}
+		// connecting may take a while (with retries), so the segment's start and
+		// deadline are only set once both sources are open
+		stream.audio.SetSource(req.AudioURL)
+		stream.video.SetSource(req.VideoURL)
 
-		if err := dir.load(req.OutDir); err != nil {
-			logCh <- log.NewMessage().Level(log.LLFatal).Sub("Capture()").Message("unable to load output directory").Metadata(log.Field{"error": err.Error()}).Build()
-		}
+		now := time.Now().In(s.loc)
+		end := segmentEnd(now, time.Minute*time.Duration(req.TimeLen), time.Minute*time.Duration(req.Align))
 
-		if !dir.exists(folderDate) {
-			logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("creating new output folder").Metadata(log.Field{"path": req.OutDir + folderDate}).Build()
+		fileDate := now.Format(fileLayout)
+		outPath := s.layout.Path(req.OutDir, req.Camera, now, req.OutExt)
+		stream.outPath = outPath
 
-			dir.mkdir(folderDate)
-		}
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("setting stream timestamp").Metadata(log.Field{"date": fileDate}).Build()
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("creating output folder").Metadata(log.Field{"path": filepath.Dir(outPath)}).Build()
 
-		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("started rotate routine").Metadata(log.Field{"days": req.Rotate}).Build()
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			logCh <- log.NewMessage().Level(log.LLFatal).Sub("Capture()").Message("unable to create output folder").Metadata(log.Field{"path": filepath.Dir(outPath), "error": err.Error()}).Build()
+		}
 
-		go dir.rotate(now, req.Rotate)
+		dir := s.dir()
 
-		s.Stream = &SplitStream{
-			audio:   &Stream{},
-			video:   &Stream{},
-			outPath: req.OutDir + folderDate + "/" + fileDate + req.OutExt,
-		}
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("started rotate routine").Metadata(log.Field{
+			"days":     req.Rotate,
+			"quota":    s.quota.String(),
+			"camQuota": s.cquota.String(),
+		}).Build()
 
-		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("starting to capture audio/video HTTP stream").Build()
+		go func() {
+			dir.rotate(now, req.Rotate)
+			dir.downsample(now)
+		}()
 
-		s.Stream.audio.SetSource(req.AudioURL)
-		s.Stream.video.SetSource(req.VideoURL)
-		s.Stream.audio.SetOutput(req.TmpDir + "a-" + fileDate + "_temp.mp4")
-		s.Stream.video.SetOutput(req.TmpDir + "v-" + fileDate + "_temp.mp4")
+		stream.audio.SetOutput(filepath.Join(req.TmpDir, "a-"+fileDate+"_temp.mp4"))
+		stream.video.SetOutput(filepath.Join(req.TmpDir, "v-"+fileDate+"_temp.mp4"))
 
-		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("stream started").Metadata(log.Field{"deadline": req.TimeLen}).Build()
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("stream started").Metadata(log.Field{"deadline": end}).Build()
 
-		s.Stream.SyncTimeout(time.Minute * time.Duration(req.TimeLen))
+		cut := s.control.begin(stream, now, end)
+		stream.SyncCut(time.Until(end), cut)
+		s.control.end(stream)
 
 		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Capture()").Message("merging stream").Metadata(log.Field{"video_rate": req.VideoRate}).Build()
 
-		go s.Stream.Merge(req.VideoRate)
+		go func() {
+			defer s.control.merged(stream)
+			stream.Merge(req.VideoRate)
+		}()
+	}
+
+}
+
+// loadRetention parses the request's time zone, output layout, storage quotas
+// and retention tiers
+func (s *StreamService) loadRetention() error {
+	var err error
+
+	if s.loc, err = LoadLocation(s.request.Timezone); err != nil {
+		return fmt.Errorf("failed to load time zone %q: %w", s.request.Timezone, err)
+	}
+
+	if s.layout, err = ParseLayout(s.request.Layout, s.loc); err != nil {
+		return fmt.Errorf("failed to parse output layout %q: %w", s.request.Layout, err)
 	}
 
+	if s.quota, err = ParseQuota(s.request.Quota); err != nil {
+		return fmt.Errorf("failed to parse storage quota %q: %w", s.request.Quota, err)
+	}
+
+	if s.cquota, err = ParseQuota(s.request.CamQuota); err != nil {
+		return fmt.Errorf("failed to parse camera storage quota %q: %w", s.request.CamQuota, err)
+	}
+
+	if err := validateTiers(s.request.Tiers, s.request.Rotate); err != nil {
+		return fmt.Errorf("invalid retention tiers: %w", err)
+	}
+
+	return nil
+}
+
+// ConfigureRetention sets the service up to only run retention, from req. With
+// readOnly (for dry runs), the recording index is used if it can be read, but
+// never rebuilt or written
+func (s *StreamService) ConfigureRetention(req *StreamRequest, readOnly bool) error {
+	s.request = req
+	s.request.OutDir = ExpandPath(req.OutDir)
+	s.Events.camera = req.Camera
+
+	if err := s.loadRetention(); err != nil {
+		return err
+	}
+
+	idx, err := OpenIndex(s.request.OutDir, s.layout)
+	if err == nil && len(idx.Entries) > 0 {
+		s.Index = idx
+		return nil
+	}
+
+	if readOnly {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("ConfigureRetention()").Message("recording index unavailable -- using the files' times").Metadata(log.Field{"path": s.request.OutDir}).Build()
+
+		s.Index = nil
+		return nil
+	}
+
+	s.Index, err = RebuildIndex(s.request.OutDir, s.layout)
+	return err
+}
+
+func (s *StreamService) dir() *dir {
+	return &dir{
+		root:        s.request.OutDir,
+		layout:      s.layout,
+		index:       s.Index,
+		camera:      s.request.Camera,
+		quota:       s.quota,
+		cameraQuota: s.cquota,
+		tiers:       s.request.Tiers,
+		events:      s.Events,
+	}
+}
+
+// Retention applies the rotation period and storage quotas to the output
+// directory. With dryRun, nothing is changed and the report lists the recordings
+// which would be removed. Retention tiers are applied separately, by Downsample
+func (s *StreamService) Retention(dryRun bool) *RetentionReport {
+	now := time.Now().In(s.loc)
+
+	if dryRun {
+		return s.dir().retain(now, s.request.Rotate, true)
+	}
+
+	return s.dir().rotate(now, s.request.Rotate)
+}
+
+// Downsample re-encodes the recordings which reached a new retention tier. It
+// returns once the re-encodes are done, or right away if a pass is already running
+func (s *StreamService) Downsample() {
+	s.dir().downsample(time.Now().In(s.loc))
 }
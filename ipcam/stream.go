@@ -2,10 +2,15 @@ package ipcam
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	ffmpeg "github.com/u2takey/ffmpeg-go"
@@ -16,28 +21,62 @@ type Stream struct {
 	source  io.ReadCloser
 	output  *os.File
 	outPath string
+	url     string
+	name    string
+	frames  bool
+	relay   *Broadcaster
+	events  *EventBus
+	bytes   int64
+	count   int64
+	stopped int32
+	live    int32
+	mu      sync.Mutex
+	errs    []string
 }
 
 type SplitStream struct {
-	audio   *Stream
-	video   *Stream
-	outPath string
+	audio    *Stream
+	video    *Stream
+	outPath  string
+	failDir  string
+	retries  int
+	fallback bool
+	remerge  bool
+	start    time.Time
+	end      time.Time
+	probe    *ProbeResult
+	profile  *MergeProfile
+	attempts int
+	profiles []string
+	flagged  bool
+	errs     []string
+	failed   string
+	camera   string
+	index    *Index
+	loc      *time.Location
+	guard    *diskGuard
+	events   *EventBus
 }
 
 func (s *Stream) SetSource(src string) {
 
 	defer logPanics("SetSource()")
 
-	logCh <- log.NewMessage().Level(log.LLDebug).Sub("SetSource()").Message("connecting to HTTP A/V stream").Metadata(log.Field{"addr": src}).Build()
+	// the camera's credentials are only used to connect
+	s.url = redactURL(src)
 
-	n, err := ExpBackoff(time.Second*10, func() error {
+	logCh <- log.NewMessage().Level(log.LLDebug).Sub("SetSource()").Message("connecting to HTTP A/V stream").Metadata(log.Field{"addr": s.url}).Build()
+
+	var reconnecting bool
+
+	connect := func() error {
 		resp, err := http.Get(src)
 		if err != nil {
 			logCh <- log.NewMessage().Level(log.LLError).Sub("SetSource()").Message("failed to initialize HTTP stream").Metadata(log.Field{
 				"error":   err.Error(),
 				"service": "Stream.SetSource()",
 				"inputs": map[string]interface{}{
-					"source": src,
+					"source": s.url,
 				},
 				"desc": "initializing HTTP stream from A/V endpoint, with a HTTP GET request",
 			}).Build()
@@ -50,7 +89,7 @@ func (s *Stream) SetSource(src string) {
 				"error":   "HTTP status code is not 200",
 				"service": "Stream.SetSource()",
 				"inputs": map[string]interface{}{
-					"source": src,
+					"source": s.url,
 				},
 				"response": map[string]interface{}{
 					"statusCode": resp.StatusCode,
@@ -70,7 +109,7 @@ func (s *Stream) SetSource(src string) {
 				"error":   err.Error(),
 				"service": "Stream.SetSource()",
 				"inputs": map[string]interface{}{
-					"source": src,
+					"source": s.url,
 				},
 				"response": map[string]interface{}{
 					"statusCode": resp.StatusCode,
@@ -86,10 +125,10 @@ func (s *Stream) SetSource(src string) {
 
 		if len(buf) == 0 {
 			logCh <- log.NewMessage().Level(log.LLError).Sub("SetSource()").Message("HTTP request has an empty body").Metadata(log.Field{
-				"error":   err.Error(),
+				"error":   "HTTP response body is empty",
 				"service": "Stream.SetSource()",
 				"inputs": map[string]interface{}{
-					"source": src,
+					"source": s.url,
 				},
 				"response": map[string]interface{}{
 					"statusCode": resp.StatusCode,
@@ -106,7 +145,7 @@ func (s *Stream) SetSource(src string) {
 
 		logCh <- log.NewMessage().Level(log.LLDebug).Sub("SetSource()").Message("HTTP request seems OK").Metadata(log.Field{
 			"inputs": map[string]interface{}{
-				"source": src,
+				"source": s.url,
 			},
 			"response": map[string]interface{}{
 				"statusCode": resp.StatusCode,
@@ -118,7 +157,29 @@ func (s *Stream) SetSource(src string) {
 			"desc": "initializing HTTP stream from A/V endpoint, with a HTTP GET request",
 		}).Build()
 		s.source = resp.Body
+		atomic.StoreInt32(&s.live, 1)
+		trackConnects.Inc(s.name)
+		s.events.trackUp(s.name)
 		return nil
+	}
+
+	n, err := ExpBackoff(time.Second*10, func() error {
+		err := connect()
+		if err != nil {
+			s.addError(err)
+
+			// once per connection, rather than for each attempt
+			if !reconnecting {
+				reconnecting = true
+				s.events.publish(&Event{Type: EventReconnecting, Track: s.name, Error: err.Error()})
+			}
+
+			// counted when the track goes offline, rather than for each attempt
+			if s.events.trackDown(s.name, err) {
+				trackReconnects.Inc(s.name)
+			}
+		}
+		return err
 	})
 
 	if err != nil {
@@ -126,7 +187,7 @@ func (s *Stream) SetSource(src string) {
 			"error":   err.Error(),
 			"service": "Stream.SetSource()",
 			"inputs": map[string]interface{}{
-				"source": src,
+				"source": s.url,
 			},
 			"desc":        "initializing HTTP stream from A/V endpoint, with a HTTP GET request",
 			"numAttempts": n,
@@ -139,10 +200,12 @@ func (s *Stream) SetSource(src string) {
 func (s *Stream) SetOutput(out string) {
 	logCh <- log.NewMessage().Level(log.LLDebug).Sub("SetOutput()").Message("creating output A/V stream file").Metadata(log.Field{"path": out}).Build()
 
+	s.outPath = out
+
 	output, err := os.Create(out)
 	if err != nil {
-
-		logCh <- log.NewMessage().Level(log.LLFatal).Sub("SetOutput()").Message("failed to create cache output file").Metadata(log.Field{
+		// not fatal (e.g. a full disk); the stream is skipped until the next segment
+		logCh <- log.NewMessage().Level(log.LLError).Sub("SetOutput()").Message("failed to create cache output file").Metadata(log.Field{
 			"error":   err.Error(),
 			"service": "Stream.SetOutput()",
 			"inputs": map[string]interface{}{
@@ -151,9 +214,10 @@ func (s *Stream) SetOutput(out string) {
 			"desc": "creating the output file which will contain the A/V stream",
 		}).Build()
 
+		s.addError(err)
+		return
 	}
 	s.output = output
-	s.outPath = out
 }
 
 func (s *Stream) Close() {
@@ -166,7 +230,18 @@ func (s *Stream) Copy() {
 
 	defer logPanics("Copy()")
 
+	if s.output == nil {
+		logCh <- log.NewMessage().Level(log.LLError).Sub("Copy()").Message("no output file to copy data stream to").Metadata(log.Field{"path": s.outPath}).Build()
+
+		if s.source != nil {
+			s.source.Close()
+		}
+		return
+	}
+
 	defer func() {
+		atomic.StoreInt32(&s.live, 0)
+
 		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Copy()").Message("closing inputs and outputs").Metadata(log.Field{"path": s.outPath}).Build()
 
 		err := s.output.Close()
@@ -182,9 +257,20 @@ func (s *Stream) Copy() {
 
 	logCh <- log.NewMessage().Level(log.LLDebug).Sub("Copy()").Message("copying data stream to file").Metadata(log.Field{"path": s.outPath}).Build()
 
-	n, err := io.Copy(s.output, s.source)
-	if err != nil {
+	var out io.Writer = s.output
+	if s.relay != nil {
+		out = io.MultiWriter(s.output, s.relay.writer())
+	}
+
+	n, err := io.Copy(&meter{w: out, s: s}, s.source)
+	if err != nil && atomic.LoadInt32(&s.stopped) == 0 {
 		logCh <- log.NewMessage().Level(log.LLError).Sub("Copy()").Message("failed to copy data").Metadata(log.Field{"path": s.outPath, "error": err.Error()}).Build()
+
+		s.addError(err)
+
+		if s.events.trackDown(s.name, err) {
+			trackReconnects.Inc(s.name)
+		}
 	}
 
 	if n == 0 {
@@ -194,6 +280,61 @@ func (s *Stream) Copy() {
 	logCh <- log.NewMessage().Level(log.LLDebug).Sub("Copy()").Message("copied data successfully").Metadata(log.Field{"path": s.outPath}).Build()
 }
 
+func (s *Stream) Stop() {
+	defer logPanics("Stop()")
+
+	atomic.StoreInt32(&s.stopped, 1)
+	atomic.StoreInt32(&s.live, 0)
+
+	if s.source != nil {
+		s.source.Close()
+	}
+}
+
+// Connected returns true while the stream's HTTP source is open
+func (s *Stream) Connected() bool {
+	return atomic.LoadInt32(&s.live) == 1
+}
+
+// URL returns the track's source, without its password
+func (s *Stream) URL() string {
+	return s.url
+}
+
+// redactURL replaces the password in raw, so that the camera's credentials
+// aren't published in the status, events, sidecars or logs. URLs which can't be
+// parsed are dropped
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+
+	return u.Redacted()
+}
+
+func (s *Stream) Bytes() int64 {
+	return atomic.LoadInt64(&s.bytes)
+}
+
+func (s *Stream) Frames() int64 {
+	return atomic.LoadInt64(&s.count)
+}
+
+func (s *Stream) Errors() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.errs...)
+}
+
+func (s *Stream) addError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errs = append(s.errs, err.Error())
+}
+
 func (s *Stream) CopyTimeout(wait time.Duration) {
 	defer logPanics("CopyTimeout()")
 	go s.Copy()
@@ -201,61 +342,204 @@ func (s *Stream) CopyTimeout(wait time.Duration) {
 }
 
 func (s *SplitStream) SyncTimeout(wait time.Duration) {
-	defer logPanics("SyncTimeout()")
+	s.SyncCut(wait, nil)
+}
 
-	go s.audio.Copy()
-	go s.video.Copy()
+// SyncCut is like SyncTimeout, but also ends the segment early once cut is closed
+func (s *SplitStream) SyncCut(wait time.Duration, cut <-chan struct{}) {
+	defer logPanics("SyncCut()")
 
-	time.Sleep(wait)
+	s.start = s.now()
+
+	s.events.publish(&Event{Type: EventSegmentStarted, Time: s.start, Output: s.outPath})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		s.audio.Copy()
+	}()
+	go func() {
+		defer wg.Done()
+		s.video.Copy()
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	watching := make(chan struct{})
+	defer close(watching)
+
+	go s.watch(watching)
+
+	msg := "stream deadline reached"
+	end := "deadline"
+
+	select {
+	case <-timer.C:
+	case <-cut:
+		msg = "stream segment cut"
+		end = "cut"
+	}
+
+	s.end = s.now()
+
+	segmentsTotal.Inc(end)
+	segmentDuration.Observe(s.end.Sub(s.start).Seconds())
+
+	s.events.publish(&Event{Type: EventSegmentFinished, Time: s.end, Output: s.outPath, Reason: end})
+
+	// close the HTTP streams so that the copy routines return
+	s.audio.Stop()
+	s.video.Stop()
+
+	wg.Wait()
+
+	logCh <- log.NewMessage().Sub("SyncCut()").Message(msg).Build()
+}
+
+// stallTimeout is how long a connected stream may go without receiving data
+// before it's reported as stalled
+const stallTimeout = 15 * time.Second
+
+// watch reports the tracks which stop receiving data while connected, until
+// done is closed
+func (s *SplitStream) watch(done <-chan struct{}) {
+	defer logPanics("watch()")
+
+	ticker := time.NewTicker(stallTimeout)
+	defer ticker.Stop()
 
-	logCh <- log.NewMessage().Sub("SyncTimeout()").Message("stream deadline reached").Build()
+	last := map[*Stream]int64{}
+	stalled := map[*Stream]bool{}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, track := range []*Stream{s.audio, s.video} {
+				n := track.Bytes()
+
+				switch {
+				case n != last[track]:
+					stalled[track] = false
+				case track.Connected() && !stalled[track]:
+					stalled[track] = true
+
+					logCh <- log.NewMessage().Level(log.LLWarn).Sub("watch()").Message("stream stalled -- no data received").Metadata(log.Field{"track": track.name, "url": track.url, "timeout": stallTimeout.String()}).Build()
+
+					s.events.publish(&Event{Type: EventStalled, Output: s.outPath, Track: track.name})
+				}
+
+				last[track] = n
+			}
+		}
+	}
+}
+
+func (s *SplitStream) now() time.Time {
+	if s.loc == nil {
+		return time.Now()
+	}
+	return time.Now().In(s.loc)
 }
 
 func (s *SplitStream) Merge(videoRate string) {
+	// e.g. a segment cut while connecting; there is nothing to merge or retry
+	if s.video.Bytes() == 0 && s.audio.Bytes() == 0 {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("Merge()").Message("segment has no data -- skipping merge").Metadata(log.Field{"output": s.outPath}).Build()
+
+		s.Cleanup()
+		return
+	}
+
 	logCh <- log.NewMessage().Sub("Merge()").Message("initialized merge workflow").Build()
 
-	err := ffmpeg.Output(
-		[]*ffmpeg.Stream{
-			ffmpeg.Input(
-				s.video.outPath,
-				ffmpeg.KwArgs{"vsync": "1"},
-				ffmpeg.KwArgs{"r": videoRate},
-			),
-			ffmpeg.Input(s.audio.outPath),
-		},
-		s.outPath,
-		ffmpeg.KwArgs{"input_format": "1"},
-		ffmpeg.KwArgs{"b:v": "4000k"},
-		ffmpeg.KwArgs{"c:v": "libx264"},
-		ffmpeg.KwArgs{"c:a": "aac"},
-		ffmpeg.KwArgs{"pix_fmt": "yuv420p"},
-	).OverWriteOutput().ErrorToStdOut().Run()
+	var errs []error
+
+	started := time.Now()
+
+	n, err := RetryBackoff(s.retries, func(attempt int) error {
+		mergeAttempts.Inc("")
+
+		profile := s.profileFor(attempt)
+		s.profile = profile
+		s.attempts = attempt
+		s.profiles = append(s.profiles, profile.Name)
+
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("Merge()").Message("merging cached A/V files").Metadata(log.Field{
+			"attempt": attempt,
+			"profile": profile.Name,
+		}).Build()
+
+		err := s.merge(profile, videoRate)
+		if err != nil {
+			logCh <- log.NewMessage().Level(log.LLError).Sub("Merge()").Message("unable to merge the cached A/V files").Metadata(log.Field{
+				"error":   err.Error(),
+				"service": "SplitStream.Merge()",
+				"inputs": map[string]interface{}{
+					"video": s.video.outPath,
+					"audio": s.audio.outPath,
+				},
+				"desc":    "merging cached audio and cached video into one file",
+				"attempt": attempt,
+				"proc": map[string]interface{}{
+					"input": map[string]interface{}{
+						"video": map[string]interface{}{
+							"vsync": "1",
+							"r":     videoRate,
+						},
+					},
+					"profile": profile.Name,
+					"output":  profile.Output,
+				},
+			}).Build()
+
+			errs = append(errs, err)
+			s.errs = append(s.errs, err.Error())
+		}
+		return err
+	})
+
 	if err != nil {
-		logCh <- log.NewMessage().Level(log.LLError).Sub("Merge()").Message("unable to merge the cached A/V files").Metadata(log.Field{
-			"error":   err.Error(),
-			"service": "SplitStream.Merge()",
-			"inputs": map[string]interface{}{
+		logCh <- log.NewMessage().Level(log.LLError).Sub("Merge()").Message("giving up on merge -- quarantining cached files").Metadata(log.Field{
+			"error":       err.Error(),
+			"numAttempts": n,
+			"cache": map[string]interface{}{
 				"video": s.video.outPath,
 				"audio": s.audio.outPath,
 			},
-			"desc": "merging cached audio and cached video into one file, using libx264",
-			"proc": map[string]interface{}{
-				"input": map[string]interface{}{
-					"video": map[string]interface{}{
-						"vsync": "1",
-						"r":     videoRate,
-					},
-				},
-				"output": map[string]interface{}{
-					"input_format": "1",
-					"b:v":          "4000k",
-					"c:v":          "libx264",
-					"c:a":          "aac",
-					"pix_fmt":      "yuv420p",
-				},
-			},
 		}).Build()
 
+		if err := s.quarantine(videoRate, errs); err != nil {
+			logCh <- log.NewMessage().Level(log.LLError).Sub("Merge()").Message("failed to quarantine cached A/V files").Metadata(log.Field{
+				"error":   err.Error(),
+				"service": "SplitStream.Merge()",
+				"inputs": map[string]interface{}{
+					"video": s.video.outPath,
+					"audio": s.audio.outPath,
+				},
+				"desc": "moving cached audio and cached video files to the failed directory",
+			}).Build()
+		}
+
+		mergesTotal.Inc(ResultFailed)
+		mergeDuration.Observe(time.Since(started).Seconds())
+
+		s.finalise(videoRate, ResultFailed)
+		return
+	}
+
+	if s.remerge && s.probe != nil && !s.probe.OK() {
+		s.flagRemerge(videoRate)
+
+		mergesTotal.Inc(ResultMerged)
+		mergeDuration.Observe(time.Since(started).Seconds())
+
+		s.finalise(videoRate, ResultMerged)
+		return
 	}
 
 	logCh <- log.NewMessage().Sub("Merge()").Message("cleaning up cached files").Metadata(log.Field{
@@ -278,6 +562,120 @@ func (s *SplitStream) Merge(videoRate string) {
 			}).Build()
 		}
 	}
+
+	mergesTotal.Inc(ResultMerged)
+	mergeDuration.Observe(time.Since(started).Seconds())
+
+	s.finalise(videoRate, ResultMerged)
+}
+
+// flagRemerge keeps the cached A/V files of a merged file which failed
+// verification in the failed directory, flagging the recording in its metadata,
+// so it can be merged again (e.g. with other settings)
+func (s *SplitStream) flagRemerge(videoRate string) {
+	err := fmt.Errorf("merged file failed verification: %s", strings.Join(s.probe.Mismatch, "; "))
+
+	if err := s.quarantine(videoRate, []error{err}); err != nil {
+		logCh <- log.NewMessage().Level(log.LLError).Sub("flagRemerge()").Message("failed to keep cached A/V files for a re-merge").Metadata(log.Field{
+			"error": err.Error(),
+			"cache": map[string]interface{}{
+				"video": s.video.outPath,
+				"audio": s.audio.outPath,
+			},
+		}).Build()
+		return
+	}
+
+	s.flagged = true
+
+	logCh <- log.NewMessage().Level(log.LLWarn).Sub("flagRemerge()").Message("flagged recording for a re-merge").Metadata(log.Field{"output": s.outPath, "cache": s.failed}).Build()
+}
+
+func (s *SplitStream) profileFor(attempt int) *MergeProfile {
+	if s.guard.Degraded() {
+		return LowDiskProfile
+	}
+	if s.fallback && attempt > 1 && attempt >= s.retries {
+		return FallbackProfile
+	}
+	return DefaultProfile
+}
+
+func (s *SplitStream) merge(profile *MergeProfile, videoRate string) error {
+	partial := partialPath(s.outPath)
+
+	err := ffmpeg.Output(
+		[]*ffmpeg.Stream{
+			ffmpeg.Input(
+				s.video.outPath,
+				ffmpeg.KwArgs{"vsync": "1"},
+				ffmpeg.KwArgs{"r": videoRate},
+			),
+			ffmpeg.Input(s.audio.outPath),
+		},
+		partial,
+		profile.Output,
+	).OverWriteOutput().ErrorToStdOut().Run()
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	if err := verifyPartial(partial); err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	s.verify(partial)
+
+	out, err := commitFile(partial, s.outPath)
+	if err != nil {
+		return err
+	}
+
+	if out != s.outPath {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("merge()").Message("output file already exists -- using a new name").Metadata(log.Field{
+			"path":   s.outPath,
+			"output": out,
+		}).Build()
+
+		s.outPath = out
+	}
+
+	return nil
+}
+
+// verify probes the merged file at path, recording any mismatch with the
+// expected recording
+func (s *SplitStream) verify(path string) {
+	if s.end.IsZero() {
+		s.end = s.now()
+	}
+
+	res, err := probe(path, s.end.Sub(s.start))
+	if err != nil {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("verify()").Message("unable to probe merged file").Metadata(log.Field{"path": path, "error": err.Error()}).Build()
+
+		return
+	}
+
+	s.probe = res
+
+	if res.OK() {
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("verify()").Message("merged file verified").Metadata(log.Field{"path": path, "probe": res}).Build()
+
+		return
+	}
+
+	// merging the same files again gives the same result, so the output is kept
+	// with the mismatch recorded in its metadata; with remerge, the cached files
+	// are kept too (see flagRemerge), to merge them again by hand
+	logCh <- log.NewMessage().Level(log.LLWarn).Sub("verify()").Message("merged file does not match the expected recording").Metadata(log.Field{
+		"path":     path,
+		"probe":    res,
+		"mismatch": res.Mismatch,
+		"remerge":  s.remerge,
+	}).Build()
 }
 
 func (s *SplitStream) Cleanup() []error {
@@ -0,0 +1,220 @@
+package ipcam
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+	"github.com/zalgonoise/zlog/log"
+)
+
+// RetentionTier re-encodes recordings older than Days with a smaller profile,
+// replacing the original. Recordings are only deleted once the rotation period,
+// which follows the last tier, expires
+type RetentionTier struct {
+	Days    int    `json:"days"`
+	Profile string `json:"profile"`
+}
+
+// tierMu keeps a single downsampling pass running, as rotation starts on every segment
+var tierMu sync.Mutex
+
+// ParseTiers reads retention tiers formatted as "days:profile", separated by
+// commas (e.g. "3:archive,14:archive-low")
+func ParseTiers(value string) ([]*RetentionTier, error) {
+	var tiers []*RetentionTier
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		days, profile, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention tier %q, expected days:profile", item)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(days))
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention tier days in %q", item)
+		}
+
+		tiers = append(tiers, &RetentionTier{Days: n, Profile: strings.TrimSpace(profile)})
+	}
+
+	return tiers, nil
+}
+
+// validateTiers sorts the tiers by age, and checks them against the rotation period
+func validateTiers(tiers []*RetentionTier, rotate int) error {
+	sort.Slice(tiers, func(a, b int) bool {
+		return tiers[a].Days < tiers[b].Days
+	})
+
+	for n, t := range tiers {
+		if t.Days <= 0 {
+			return fmt.Errorf("retention tier days must be positive, got %d", t.Days)
+		}
+
+		if n > 0 && tiers[n-1].Days == t.Days {
+			return fmt.Errorf("more than one retention tier for %d days", t.Days)
+		}
+
+		if _, ok := Profiles[t.Profile]; !ok {
+			return fmt.Errorf("unknown profile %q in retention tier", t.Profile)
+		}
+
+		if t.Days >= rotate {
+			return fmt.Errorf("retention tier of %d days must be shorter than the rotation period of %d days", t.Days, rotate)
+		}
+	}
+
+	return nil
+}
+
+// tierFor returns the last tier (1-based) reached by a recording from date, by from
+func (d *dir) tierFor(rec *recording, from time.Time) int {
+	t := rec.start.In(from.Location())
+	date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	tier := 0
+	for n, rt := range d.tiers {
+		if date.Before(from.Add(time.Duration(-rt.Days) * 24 * time.Hour)) {
+			tier = n + 1
+		}
+	}
+
+	return tier
+}
+
+// downsample re-encodes the recordings which reached a new retention tier
+func (d *dir) downsample(from time.Time) {
+	if len(d.tiers) == 0 || !tierMu.TryLock() {
+		return
+	}
+	defer tierMu.Unlock()
+
+	recs, errs := d.recordings()
+
+	for _, err := range errs {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("downsample()").Message("failed to list stream files").Metadata(log.Field{"error": err.Error()}).Build()
+	}
+
+	for _, rec := range recs {
+		tier := d.tierFor(rec, from)
+
+		// protected recordings are kept as they are; sidecars without a video are skipped
+		if tier == 0 || rec.protected != nil || filepath.Ext(rec.path) == sidecarExt {
+			continue
+		}
+
+		info, err := ReadSegmentInfo(sidecarPath(rec.path))
+		if err != nil {
+			info = &SegmentInfo{
+				Camera: rec.camera,
+				Output: rec.path,
+				Start:  rec.start,
+				End:    rec.end,
+				Result: ResultMerged,
+			}
+		}
+
+		if info.Tier >= tier {
+			continue
+		}
+
+		profile := Profiles[d.tiers[tier-1].Profile]
+
+		logCh <- log.NewMessage().Sub("downsample()").Message("re-encoding recording for retention tier").Metadata(log.Field{
+			"target":  rec.path,
+			"tier":    tier,
+			"profile": profile.Name,
+			"size":    rec.size,
+		}).Build()
+
+		partial, size, err := reencode(rec.path, profile)
+		if err != nil {
+			logCh <- log.NewMessage().Level(log.LLError).Sub("downsample()").Message("failed to re-encode recording").Metadata(log.Field{"target": rec.path, "profile": profile.Name, "error": err.Error()}).Build()
+			continue
+		}
+
+		info.Tier = tier
+		info.Profile = profile.Name
+
+		if err := d.commitTier(rec.path, partial, size, info); err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("downsample()").Message("discarding re-encoded recording").Metadata(log.Field{"target": rec.path, "error": err.Error()}).Build()
+			continue
+		}
+
+		logCh <- log.NewMessage().Sub("downsample()").Message("recording re-encoded").Metadata(log.Field{
+			"target":  rec.path,
+			"tier":    tier,
+			"profile": profile.Name,
+			"before":  rec.size,
+			"after":   size,
+		}).Build()
+	}
+}
+
+// reencode encodes a copy of the recording at path with profile, returning the
+// path and size of the copy, to replace the recording with commitTier
+func reencode(path string, profile *MergeProfile) (string, int64, error) {
+	partial := partialPath(path)
+
+	err := ffmpeg.Input(path).Output(partial, profile.Output).OverWriteOutput().ErrorToStdOut().Run()
+	if err != nil {
+		os.Remove(partial)
+		return "", 0, err
+	}
+
+	if err := verifyPartial(partial); err != nil {
+		os.Remove(partial)
+		return "", 0, err
+	}
+
+	stat, err := os.Stat(partial)
+	if err != nil {
+		os.Remove(partial)
+		return "", 0, err
+	}
+
+	return partial, stat.Size(), nil
+}
+
+// commitTier replaces the recording at path with its re-encoded copy, and
+// updates its sidecar and index entry. Retention may remove the recording while
+// it is re-encoded, so the copy is discarded if the recording is gone, rather
+// than bringing it (or its sidecar) back
+func (d *dir) commitTier(path, partial string, size int64, info *SegmentInfo) error {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	if _, err := os.Stat(path); err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	if err := os.Rename(partial, path); err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	if err := writeJSON(sidecarPath(path), info); err != nil {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("commitTier()").Message("failed to update segment metadata").Metadata(log.Field{"target": path, "error": err.Error()}).Build()
+	}
+
+	if d.index != nil {
+		if err := d.index.Resize(path, size); err != nil {
+			logCh <- log.NewMessage().Level(log.LLWarn).Sub("commitTier()").Message("failed to update recording index").Metadata(log.Field{"target": path, "error": err.Error()}).Build()
+		}
+	}
+
+	return nil
+}
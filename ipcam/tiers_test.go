@@ -0,0 +1,122 @@
+package ipcam
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTiers(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		ok    bool
+		want  []*RetentionTier
+	}{
+		{"", true, nil},
+		{"3:archive", true, []*RetentionTier{{Days: 3, Profile: "archive"}}},
+		{"3:archive,14:archive-low", true, []*RetentionTier{{Days: 3, Profile: "archive"}, {Days: 14, Profile: "archive-low"}}},
+		{" 3 : archive , 14:archive-low ,", true, []*RetentionTier{{Days: 3, Profile: "archive"}, {Days: 14, Profile: "archive-low"}}},
+		{"3", false, nil},
+		{"three:archive", false, nil},
+		{"3:archive,14", false, nil},
+	} {
+		got, err := ParseTiers(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseTiers(%q): got error %v, want ok = %v", test.value, err, test.ok)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseTiers(%q): got %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestValidateTiers(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		tiers  []*RetentionTier
+		rotate int
+		ok     bool
+	}{
+		{"none", nil, 7, true},
+		{"one", []*RetentionTier{{Days: 3, Profile: "archive"}}, 7, true},
+		{"two", []*RetentionTier{{Days: 3, Profile: "archive"}, {Days: 5, Profile: "archive-low"}}, 7, true},
+		{"zero days", []*RetentionTier{{Days: 0, Profile: "archive"}}, 7, false},
+		{"negative days", []*RetentionTier{{Days: -1, Profile: "archive"}}, 7, false},
+		{"unknown profile", []*RetentionTier{{Days: 3, Profile: "tiny"}}, 7, false},
+		{"at the rotation period", []*RetentionTier{{Days: 7, Profile: "archive"}}, 7, false},
+		{"past the rotation period", []*RetentionTier{{Days: 10, Profile: "archive"}}, 7, false},
+		{"duplicate days", []*RetentionTier{{Days: 3, Profile: "archive"}, {Days: 3, Profile: "archive-low"}}, 7, false},
+	} {
+		if err := validateTiers(test.tiers, test.rotate); (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok = %v", test.name, err, test.ok)
+		}
+	}
+
+	// tiers are sorted by age
+	tiers := []*RetentionTier{{Days: 5, Profile: "archive-low"}, {Days: 2, Profile: "archive"}}
+	if err := validateTiers(tiers, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	if tiers[0].Days != 2 || tiers[1].Days != 5 {
+		t.Errorf("tiers not sorted: %v, %v", tiers[0], tiers[1])
+	}
+}
+
+func TestCommitTier(t *testing.T) {
+	d := testDir(t, time.UTC)
+
+	start := time.Date(2022, 5, 30, 10, 0, 0, 0, time.UTC)
+	path := d.record(t, "front", start, start.Add(time.Hour), 100)
+	d.indexed(t)
+
+	partial := partialPath(path)
+	if err := os.WriteFile(partial, make([]byte, 40), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &SegmentInfo{Camera: "front", Output: path, Start: start, End: start.Add(time.Hour), Tier: 1, Profile: "archive"}
+
+	if err := d.commitTier(path, partial, 40, info); err != nil {
+		t.Fatal(err)
+	}
+
+	if stat, err := os.Stat(path); err != nil || stat.Size() != 40 {
+		t.Errorf("recording wasn't replaced: %v", err)
+	}
+	if exists(partial) {
+		t.Error("partial file left behind")
+	}
+	if got, err := ReadSegmentInfo(sidecarPath(path)); err != nil || got.Tier != 1 || got.Profile != "archive" {
+		t.Errorf("sidecar wasn't updated: %v, %v", got, err)
+	}
+	if entries := d.index.Query("", time.Time{}, time.Time{}); len(entries) != 1 || entries[0].Bytes != 40 {
+		t.Errorf("index entry wasn't resized: %v", entries)
+	}
+
+	// retention removed the recording while it was re-encoded
+	if err := d.remove(&removal{rec: &recording{path: path, files: []string{path, sidecarPath(path)}}, reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partial, make([]byte, 20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.commitTier(path, partial, 20, info); err == nil {
+		t.Error("committed a re-encode of a removed recording")
+	}
+
+	if exists(path) || exists(sidecarPath(path)) || exists(partial) {
+		t.Errorf("files left: recording %v, sidecar %v, partial %v", exists(path), exists(sidecarPath(path)), exists(partial))
+	}
+	if entries := d.index.Query("", time.Time{}, time.Time{}); len(entries) != 0 {
+		t.Errorf("removed recording is back in the index: %v", entries)
+	}
+}
@@ -0,0 +1,253 @@
+package ipcam
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zalgonoise/zlog/log"
+)
+
+const (
+	webhookLog = "webhooks.log"
+
+	// webhookBackoff is the longest wait between delivery attempts; deliveries
+	// are given up after about 30s, so that a failing endpoint doesn't hold
+	// back the hook's later events for long
+	webhookBackoff = 16 * time.Second
+	webhookTimeout = 10 * time.Second
+
+	// maxDeliveryLog is the size of the delivery log before it's rotated
+	maxDeliveryLog   = 10 << 20
+	recentDeliveries = 100
+)
+
+// Webhook POSTs the recorder's events as JSON to URL. If Events is set, only
+// those event types are sent. If Secret is set, each request carries a
+// signature in the X-Ipcam-Signature header, as "t=<unix time>,sha256=<hex>":
+// the HMAC-SHA256 of the timestamp, a dot and the body. Receivers should reject
+// stale timestamps, so that captured deliveries can't be replayed
+type Webhook struct {
+	Name   string      `json:"name"`
+	URL    string      `json:"url"`
+	Events []EventType `json:"events,omitempty"`
+	Secret string      `json:"secret,omitempty"`
+}
+
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("webhook %q: %w", w.Name, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook %q: URL must be http or https", w.Name)
+	}
+
+	for _, e := range w.Events {
+		if !knownEvents[e] {
+			return fmt.Errorf("webhook %q: unknown event type %q", w.Name, e)
+		}
+	}
+
+	return nil
+}
+
+func (w *Webhook) accepts(e *Event) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, t := range w.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery records an attempt to deliver an event to a webhook
+type Delivery struct {
+	ID       string    `json:"id"`
+	Webhook  string    `json:"webhook"`
+	URL      string    `json:"url"`
+	Event    EventType `json:"event"`
+	Time     time.Time `json:"time"`
+	Attempts int       `json:"attempts"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration float64   `json:"duration"`
+}
+
+// webhooks delivers events to the configured webhooks, logging each delivery
+// to a JSON lines file in the output directory
+type webhooks struct {
+	hooks  []*Webhook
+	client *http.Client
+	path   string
+
+	mu     sync.Mutex
+	recent []*Delivery
+}
+
+func newWebhooks(hooks []*Webhook, root string) *webhooks {
+	return &webhooks{
+		hooks:  hooks,
+		client: &http.Client{Timeout: webhookTimeout},
+		path:   filepath.Join(root, webhookLog),
+	}
+}
+
+// start subscribes each webhook to the event bus; each one delivers its events
+// in order, so a slow endpoint only delays (or drops) its own events
+func (w *webhooks) start(bus *EventBus) {
+	for _, hook := range w.hooks {
+		hook := hook
+
+		bus.Handle("webhook:"+hook.Name, func(e *Event) {
+			if hook.accepts(e) {
+				w.deliver(hook, e)
+			}
+		})
+	}
+}
+
+func (w *webhooks) deliver(hook *Webhook, e *Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	d := &Delivery{
+		ID:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		Webhook: hook.Name,
+		URL:     hook.URL,
+		Event:   e.Type,
+		Time:    time.Now(),
+	}
+
+	n, err := ExpBackoff(webhookBackoff, func() error {
+		status, err := w.post(hook, d.ID, e.Type, body)
+		d.Status = status
+		return err
+	})
+
+	d.Attempts = n
+	d.Duration = time.Since(d.Time).Seconds()
+
+	if err != nil {
+		d.Error = err.Error()
+
+		logCh <- log.NewMessage().Level(log.LLError).Sub("webhooks.deliver()").Message("failed to deliver webhook").Metadata(log.Field{
+			"webhook":  hook.Name,
+			"event":    e.Type,
+			"attempts": n,
+			"error":    err.Error(),
+		}).Build()
+	} else {
+		logCh <- log.NewMessage().Level(log.LLDebug).Sub("webhooks.deliver()").Message("delivered webhook").Metadata(log.Field{
+			"webhook":  hook.Name,
+			"event":    e.Type,
+			"attempts": n,
+		}).Build()
+	}
+
+	w.record(d)
+}
+
+func (w *webhooks) post(hook *Webhook, id string, event EventType, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ipcam-stream")
+	req.Header.Set("X-Ipcam-Event", string(event))
+	req.Header.Set("X-Ipcam-Delivery", id)
+
+	if hook.Secret != "" {
+		req.Header.Set("X-Ipcam-Signature", sign(hook.Secret, time.Now(), body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("webhook endpoint returned %s", resp.Status)
+
+		// the endpoint rejected the request; retrying won't change that
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return resp.StatusCode, Permanent(err)
+		}
+
+		return resp.StatusCode, err
+	}
+
+	return resp.StatusCode, nil
+}
+
+// sign returns the X-Ipcam-Signature header for body, sent at t
+func sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+
+	return "t=" + ts + ",sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// record appends the delivery to the log file, rotating it when it grows too large
+func (w *webhooks) record(d *Delivery) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.recent = append(w.recent, d)
+	if len(w.recent) > recentDeliveries {
+		w.recent = w.recent[len(w.recent)-recentDeliveries:]
+	}
+
+	if stat, err := os.Stat(w.path); err == nil && stat.Size() > maxDeliveryLog {
+		os.Rename(w.path, w.path+".1")
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logCh <- log.NewMessage().Level(log.LLWarn).Sub("webhooks.record()").Message("failed to open webhook delivery log").Metadata(log.Field{"path": w.path, "error": err.Error()}).Build()
+		return
+	}
+	defer f.Close()
+
+	f.Write(append(data, '\n'))
+}
+
+// Deliveries returns the most recent webhook deliveries, oldest first
+func (w *webhooks) Deliveries() []*Delivery {
+	if w == nil {
+		return []*Delivery{}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]*Delivery{}, w.recent...)
+}
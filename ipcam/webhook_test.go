@@ -0,0 +1,163 @@
+package ipcam
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookValidate(t *testing.T) {
+	for _, test := range []struct {
+		hook *Webhook
+		ok   bool
+	}{
+		{&Webhook{Name: "a", URL: "https://example.com/hook"}, true},
+		{&Webhook{Name: "a", URL: "http://example.com/hook", Events: []EventType{EventMerged, EventOffline}}, true},
+		{&Webhook{Name: "a", URL: "ftp://example.com/hook"}, false},
+		{&Webhook{Name: "a", URL: "://bad"}, false},
+		{&Webhook{Name: "a", URL: "https://example.com/hook", Events: []EventType{"segment.exploded"}}, false},
+	} {
+		if err := test.hook.Validate(); (err == nil) != test.ok {
+			t.Errorf("%s %v: got error %v, want ok = %v", test.hook.URL, test.hook.Events, err, test.ok)
+		}
+	}
+}
+
+func TestWebhookAccepts(t *testing.T) {
+	all := &Webhook{}
+	some := &Webhook{Events: []EventType{EventMergeFailed, EventDiskLow}}
+
+	for _, test := range []struct {
+		hook *Webhook
+		e    EventType
+		want bool
+	}{
+		{all, EventSegmentStarted, true},
+		{some, EventDiskLow, true},
+		{some, EventSegmentStarted, false},
+	} {
+		if got := test.hook.accepts(&Event{Type: test.e}); got != test.want {
+			t.Errorf("%v accepts %s: got %v, want %v", test.hook.Events, test.e, got, test.want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"type":"segment.merged"}`)
+	at := time.Unix(1650000000, 0)
+
+	got := sign("secret", at, body)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1650000000." + string(body)))
+	want := "t=1650000000,sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// the same body sent later has a different signature
+	if sign("secret", at.Add(time.Second), body) == got {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		status   int
+		attempts int
+		failed   bool
+	}{
+		{"ok", http.StatusNoContent, 1, false},
+		{"rejected", http.StatusBadRequest, 1, true},
+		{"gone", http.StatusGone, 1, true},
+	} {
+		var calls int32
+		var signature, event string
+		var body []byte
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			signature = r.Header.Get("X-Ipcam-Signature")
+			event = r.Header.Get("X-Ipcam-Event")
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(test.status)
+		}))
+
+		hook := &Webhook{Name: "test", URL: srv.URL, Secret: "secret"}
+		w := newWebhooks([]*Webhook{hook}, t.TempDir())
+
+		w.deliver(hook, &Event{Type: EventMerged, Output: "out.mp4"})
+		srv.Close()
+
+		if int(calls) != test.attempts {
+			t.Errorf("%s: got %d attempts, want %d", test.name, calls, test.attempts)
+		}
+
+		if event != string(EventMerged) {
+			t.Errorf("%s: got event header %q", test.name, event)
+		}
+
+		ts := strings.TrimPrefix(strings.SplitN(signature, ",", 2)[0], "t=")
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+
+		if !strings.HasSuffix(signature, ",sha256="+hex.EncodeToString(mac.Sum(nil))) {
+			t.Errorf("%s: signature %q doesn't match the body", test.name, signature)
+		}
+
+		deliveries := w.Deliveries()
+		if len(deliveries) != 1 {
+			t.Fatalf("%s: got %d deliveries, want 1", test.name, len(deliveries))
+		}
+
+		if d := deliveries[0]; (d.Error != "") != test.failed || d.Status != test.status || d.Attempts != test.attempts {
+			t.Errorf("%s: unexpected delivery %+v", test.name, d)
+		}
+
+		if filepath.Base(w.path) != webhookLog {
+			t.Errorf("%s: unexpected delivery log %s", test.name, w.path)
+		}
+	}
+}
+
+func TestTrackEdges(t *testing.T) {
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe("test")
+	defer unsubscribe()
+
+	bus.trackUp("video")
+
+	// reconnects are counted when trackDown reports the track went offline
+	if !bus.trackDown("video", io.EOF) {
+		t.Error("video: trackDown didn't report going offline")
+	}
+	if bus.trackDown("video", io.EOF) {
+		t.Error("video: trackDown reported going offline while offline")
+	}
+
+	bus.trackDown("audio", io.EOF)
+	bus.trackUp("video")
+	bus.trackUp("video")
+
+	var got []string
+	for len(events) > 0 {
+		e := <-events
+		got = append(got, string(e.Type)+":"+e.Track)
+	}
+
+	want := "camera.offline:video camera.offline:audio camera.online:video"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}